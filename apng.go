@@ -4,10 +4,69 @@
 
 package apng
 
+import (
+	"time"
+)
+
 type APNG struct {
 	Frames []Frame
 	// LoopCount defines the number of times an animation will be
 	// restarted during display.
 	// A LoopCount of 0 means to loop forever
 	LoopCount uint
+	// Keyframes lists the indices in Frames of keyframes: frames that
+	// cover the whole canvas with BLEND_OP_SOURCE, so that a player can
+	// seek to them without compositing the frames before. It is written
+	// to and read from the private kfIX chunk. Encoding fails if any is
+	// not such a frame, while decoding leaves Keyframes nil if the chunk
+	// is malformed or lists one.
+	Keyframes []int
+}
+
+// TotalDuration returns how long one play of the animation takes: the sum of
+// the durations of its frames, not counting a default image.
+func (a *APNG) TotalDuration() time.Duration {
+	var total time.Duration
+	for i := range a.Frames {
+		if !a.Frames[i].IsDefault {
+			total += a.Frames[i].Duration()
+		}
+	}
+	return total
+}
+
+// FrameAt returns the index in Frames of the frame shown at time t after the
+// animation starts. The animation restarts after each play, and stops on its
+// last frame once it has been played LoopCount times, unless LoopCount is 0.
+// Frames with a duration of 0 are never returned, unless they are last. A
+// negative t is treated as 0. FrameAt returns -1 if a has no frames, and 0 if
+// its only frame is a default image.
+func (a *APNG) FrameAt(t time.Duration) int {
+	first := 0
+	if len(a.Frames) > 0 && a.Frames[0].IsDefault {
+		first = 1
+	}
+	if first >= len(a.Frames) {
+		return len(a.Frames) - 1
+	}
+	last := len(a.Frames) - 1
+	total := a.TotalDuration()
+	if t < 0 {
+		t = 0
+	}
+	if total == 0 {
+		return last
+	}
+	if a.LoopCount != 0 && uint64(t/total) >= uint64(a.LoopCount) {
+		return last
+	}
+	t %= total
+	for i := first; i < last; i++ {
+		d := a.Frames[i].Duration()
+		if t < d {
+			return i
+		}
+		t -= d
+	}
+	return last
 }
@@ -0,0 +1,249 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// compositor renders the frames of an animation onto a canvas the way a
+// player displays them, following each frame's offsets, BlendOp and
+// DisposeOp. The canvas is kept as non-alpha-premultiplied 16-bit color, so
+// that the colors of both 8-bit and 16-bit frames are kept exactly.
+type compositor struct {
+	canvas *image.NRGBA64
+	// saved holds the part of the canvas under the last drawn frame, from
+	// before it was drawn, for DISPOSE_OP_PREVIOUS.
+	saved *image.NRGBA64
+	// last is the region of the canvas covered by the last drawn frame, and
+	// disposeOp is how it is disposed of before the next frame is drawn.
+	last      image.Rectangle
+	disposeOp byte
+	drawn     int
+	// linear blends BLEND_OP_OVER frames in linear light, with
+	// blendOverLinear, rather than as per the APNG spec.
+	linear bool
+}
+
+// newCompositor returns a compositor with a fully transparent canvas of the
+// given size.
+func newCompositor(width, height int) *compositor {
+	return &compositor{
+		canvas: image.NewNRGBA64(image.Rect(0, 0, width, height)),
+		saved:  &image.NRGBA64{},
+	}
+}
+
+// reset clears the canvas, as at the start of each loop of an animation.
+func (c *compositor) reset() {
+	zeroMemory(c.canvas.Pix)
+	c.last = image.Rectangle{}
+	c.disposeOp = DISPOSE_OP_NONE
+	c.drawn = 0
+}
+
+// frameRect returns the region of the canvas covered by f.
+func (c *compositor) frameRect(f Frame) image.Rectangle {
+	b := f.Image.Bounds()
+	return image.Rect(f.XOffset, f.YOffset, f.XOffset+b.Dx(), f.YOffset+b.Dy()).Intersect(c.canvas.Rect)
+}
+
+// dispose disposes of the last drawn frame.
+func (c *compositor) dispose() {
+	switch c.disposeOp {
+	case DISPOSE_OP_BACKGROUND:
+		for y := c.last.Min.Y; y < c.last.Max.Y; y++ {
+			i := c.canvas.PixOffset(c.last.Min.X, y)
+			zeroMemory(c.canvas.Pix[i : i+c.last.Dx()*8])
+		}
+	case DISPOSE_OP_PREVIOUS:
+		copyRect(c.canvas, c.last, c.saved, c.saved.Rect.Min)
+	}
+	c.disposeOp = DISPOSE_OP_NONE
+}
+
+// draw disposes of the last drawn frame and then draws f, which must not be
+// a default image.
+func (c *compositor) draw(f Frame) {
+	c.dispose()
+	r := c.frameRect(f)
+
+	// Save what is under the frame, in case it is disposed of with
+	// DISPOSE_OP_PREVIOUS.
+	if cap(c.saved.Pix) < r.Dx()*r.Dy()*8 {
+		c.saved.Pix = make([]uint8, r.Dx()*r.Dy()*8)
+	}
+	c.saved.Pix = c.saved.Pix[:r.Dx()*r.Dy()*8]
+	c.saved.Stride = r.Dx() * 8
+	c.saved.Rect = r
+	copyRect(c.saved, r, c.canvas, r.Min)
+
+	b := f.Image.Bounds()
+	dx, dy := b.Min.X-f.XOffset, b.Min.Y-f.YOffset
+	var s [8]uint8
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := c.canvas.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			src := pixelNRGBA64(f.Image, x+dx, y+dy, s[:])
+			if f.BlendOp == BLEND_OP_OVER && c.linear {
+				blendOverLinear(c.canvas.Pix[i:i+8], src)
+			} else if f.BlendOp == BLEND_OP_OVER {
+				blendOver(c.canvas.Pix[i:i+8], src)
+			} else {
+				copy(c.canvas.Pix[i:i+8], src)
+			}
+			i += 8
+		}
+	}
+
+	c.last = r
+	c.disposeOp = f.DisposeOp
+	if c.drawn == 0 && c.disposeOp == DISPOSE_OP_PREVIOUS {
+		// As per the APNG spec, the first frame has no previous state to
+		// revert to, so it is cleared instead.
+		c.disposeOp = DISPOSE_OP_BACKGROUND
+	}
+	c.drawn++
+}
+
+// canvases returns the canvas after each frame of a, not counting a default
+// image, as a player shows them.
+func canvases(a APNG) []*image.NRGBA64 {
+	b := a.Frames[0].Image.Bounds()
+	c := newCompositor(b.Dx(), b.Dy())
+	var out []*image.NRGBA64
+	for _, f := range a.Frames {
+		if f.IsDefault {
+			continue
+		}
+		c.draw(f)
+		m := image.NewNRGBA64(c.canvas.Rect)
+		copy(m.Pix, c.canvas.Pix)
+		out = append(out, m)
+	}
+	return out
+}
+
+// cloneNRGBA64 returns a copy of m, for frames that would otherwise share an
+// image.
+func cloneNRGBA64(m *image.NRGBA64) *image.NRGBA64 {
+	n := image.NewNRGBA64(m.Rect)
+	copy(n.Pix, m.Pix)
+	return n
+}
+
+// copyRect copies the pixels of r in src, starting at sp, to r in dst.
+func copyRect(dst *image.NRGBA64, r image.Rectangle, src *image.NRGBA64, sp image.Point) {
+	for y := 0; y < r.Dy(); y++ {
+		d := dst.PixOffset(r.Min.X, r.Min.Y+y)
+		s := src.PixOffset(sp.X, sp.Y+y)
+		copy(dst.Pix[d:d+r.Dx()*8], src.Pix[s:s+r.Dx()*8])
+	}
+}
+
+// pixelNRGBA64 returns the color of m at (x, y) as the 8 bytes of an
+// image.NRGBA64 pixel, using buf if m is not an *image.NRGBA64.
+func pixelNRGBA64(m image.Image, x, y int, buf []uint8) []uint8 {
+	switch m := m.(type) {
+	case *image.NRGBA64:
+		i := m.PixOffset(x, y)
+		return m.Pix[i : i+8]
+	case *image.NRGBA:
+		i := m.PixOffset(x, y)
+		for j := 0; j < 4; j++ {
+			buf[2*j+0] = m.Pix[i+j]
+			buf[2*j+1] = m.Pix[i+j]
+		}
+		return buf
+	}
+	c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+	buf[0], buf[1] = uint8(c.R>>8), uint8(c.R)
+	buf[2], buf[3] = uint8(c.G>>8), uint8(c.G)
+	buf[4], buf[5] = uint8(c.B>>8), uint8(c.B)
+	buf[6], buf[7] = uint8(c.A>>8), uint8(c.A)
+	return buf
+}
+
+// blendOver composites the NRGBA64 pixel src over dst, as per the APNG spec's
+// BLEND_OP_OVER.
+func blendOver(dst, src []uint8) {
+	sa := uint64(src[6])<<8 | uint64(src[7])
+	switch sa {
+	case 0:
+		return
+	case 0xffff:
+		copy(dst, src)
+		return
+	}
+	da := uint64(dst[6])<<8 | uint64(dst[7])
+	// The destination's contribution, scaled by what the source lets through.
+	da = (da*(0xffff-sa) + 0x7fff) / 0xffff
+	a := sa + da
+	for i := 0; i < 6; i += 2 {
+		s := uint64(src[i])<<8 | uint64(src[i+1])
+		d := uint64(dst[i])<<8 | uint64(dst[i+1])
+		v := (s*sa + d*da + a/2) / a
+		dst[i], dst[i+1] = uint8(v>>8), uint8(v)
+	}
+	dst[6], dst[7] = uint8(a>>8), uint8(a)
+}
+
+// toLinear maps each 16-bit sRGB value to linear light, from 0 to 1. It is
+// built by linearOnce the first time it is needed.
+var (
+	toLinear   []float32
+	linearOnce sync.Once
+)
+
+func initToLinear() {
+	toLinear = make([]float32, 1<<16)
+	for i := range toLinear {
+		v := float64(i) / 0xffff
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		toLinear[i] = float32(v)
+	}
+}
+
+// fromLinear maps v, in linear light from 0 to 1, to a 16-bit sRGB value.
+func fromLinear(v float64) uint16 {
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint16(math.Max(0, math.Min(0xffff, v*0xffff+0.5)))
+}
+
+// blendOverLinear composites the NRGBA64 pixel src over dst like blendOver,
+// but mixes the colors in linear light rather than in sRGB, which avoids the
+// dark fringes that partly transparent edges get otherwise.
+func blendOverLinear(dst, src []uint8) {
+	sa := uint64(src[6])<<8 | uint64(src[7])
+	switch sa {
+	case 0:
+		return
+	case 0xffff:
+		copy(dst, src)
+		return
+	}
+	linearOnce.Do(initToLinear)
+	da := uint64(dst[6])<<8 | uint64(dst[7])
+	da = (da*(0xffff-sa) + 0x7fff) / 0xffff
+	a := sa + da
+	for i := 0; i < 6; i += 2 {
+		s := toLinear[uint16(src[i])<<8|uint16(src[i+1])]
+		d := toLinear[uint16(dst[i])<<8|uint16(dst[i+1])]
+		v := fromLinear((float64(s)*float64(sa) + float64(d)*float64(da)) / float64(a))
+		dst[i], dst[i+1] = uint8(v>>8), uint8(v)
+	}
+	dst[6], dst[7] = uint8(a>>8), uint8(a)
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"context"
+	"io"
+)
+
+// Progress reports how far encoding or decoding an APNG has got, for the
+// Progress callbacks of Encoder and Decoder.
+type Progress struct {
+	// Frames is the number of frames of the animation whose image data has
+	// been written or read. A default image that is not part of the
+	// animation is not counted.
+	Frames int
+	// TotalFrames is the number of frames of the animation, as given by the
+	// acTL chunk. It is 0 when decoding until the acTL chunk has been read,
+	// and for a PNG that is not animated.
+	TotalFrames int
+	// Bytes is the number of bytes written or read so far.
+	Bytes int64
+}
+
+// EncodeContext writes the APNG a to w in PNG format, like Encode, but
+// returns ctx.Err() as soon as ctx is done.
+func EncodeContext(ctx context.Context, w io.Writer, a APNG) error {
+	var e Encoder
+	return e.EncodeContext(ctx, w, a)
+}
+
+// DecodeAllContext reads an APNG file from r and returns it as an APNG, like
+// DecodeAll, but returns ctx.Err() as soon as ctx is done.
+func DecodeAllContext(ctx context.Context, r io.Reader) (APNG, error) {
+	var dec Decoder
+	return dec.DecodeAllContext(ctx, r)
+}
+
+// canceled returns e.ctx.Err() if e.ctx is done.
+func (e *encoder) canceled() error {
+	if e.done == nil {
+		return nil
+	}
+	select {
+	case <-e.done:
+		return e.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// report calls the Encoder's Progress callback, if any.
+func (e *encoder) report() {
+	if e.enc.Progress != nil {
+		e.enc.Progress(e.progress)
+	}
+}
+
+// canceled returns d.ctx.Err() if d.ctx is done.
+func (d *decoder) canceled() error {
+	if d.done == nil {
+		return nil
+	}
+	select {
+	case <-d.done:
+		return d.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// report calls the Decoder's Progress callback, if any.
+func (d *decoder) report() {
+	if d.progressFunc != nil {
+		d.progress.TotalFrames = int(d.numFrames)
+		d.progress.Bytes = d.count.n
+		d.progressFunc(d.progress)
+	}
+}
+
+// readCounter is an io.Reader that counts the bytes read through it.
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
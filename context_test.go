@@ -0,0 +1,118 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"testing"
+)
+
+func TestEncodeDecodeProgress(t *testing.T) {
+	a := movingSquare(5, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	// A default image is not one of the frames of the animation.
+	a.Frames = append([]Frame{{Image: a.Frames[0].Image, IsDefault: true}}, a.Frames...)
+
+	for _, concurrency := range []int{0, 3} {
+		var buf bytes.Buffer
+		var encoded []Progress
+		enc := &Encoder{
+			ChunkSize:   1024,
+			Concurrency: concurrency,
+			Progress:    func(p Progress) { encoded = append(encoded, p) },
+		}
+		if err := enc.EncodeContext(context.Background(), &buf, a); err != nil {
+			t.Fatal(err)
+		}
+		var decoded []Progress
+		dec := &Decoder{Progress: func(p Progress) { decoded = append(decoded, p) }}
+		if _, err := dec.DecodeAllContext(context.Background(), bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		want := Progress{Frames: 5, TotalFrames: 5, Bytes: int64(buf.Len())}
+		for name, progress := range map[string][]Progress{"encoding": encoded, "decoding": decoded} {
+			if len(progress) < 5 {
+				t.Fatalf("concurrency %d, %s: got %d progress reports, want at least 5", concurrency, name, len(progress))
+			}
+			if got := progress[len(progress)-1]; got != want {
+				t.Errorf("concurrency %d, %s: last progress %+v, want %+v", concurrency, name, got, want)
+			}
+			for i := 1; i < len(progress); i++ {
+				p, q := progress[i-1], progress[i]
+				if q.Frames < p.Frames || q.Bytes < p.Bytes {
+					t.Errorf("concurrency %d, %s: progress went back from %+v to %+v", concurrency, name, p, q)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeContextCanceled(t *testing.T) {
+	a := movingSquare(8, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	if err := EncodeContext(ctx, &buf, a); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes after being canceled", buf.Len())
+	}
+
+	for _, enc := range []*Encoder{{}, {Concurrency: 4}, {DeltaFrames: true}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		frames := 0
+		enc.Progress = func(p Progress) {
+			frames = p.Frames
+			if p.Frames == 2 {
+				cancel()
+			}
+		}
+		if err := enc.EncodeContext(ctx, &buf, a); err != context.Canceled {
+			t.Errorf("%+v: got error %v, want %v", enc, err, context.Canceled)
+		}
+		if frames != 2 {
+			t.Errorf("%+v: wrote %d frames, want 2", enc, frames)
+		}
+		cancel()
+	}
+}
+
+func TestDecodeAllContextCanceled(t *testing.T) {
+	a := movingSquare(8, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	var buf bytes.Buffer
+	if err := Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DecodeAllContext(ctx, bytes.NewReader(buf.Bytes())); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	frames := 0
+	dec := &Decoder{Progress: func(p Progress) {
+		frames = p.Frames
+		if p.Frames == 3 {
+			cancel()
+		}
+	}}
+	b, err := dec.DecodeAllContext(ctx, bytes.NewReader(buf.Bytes()))
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if frames != 3 {
+		t.Errorf("decoded %d frames, want 3", frames)
+	}
+	for i, f := range b.Frames {
+		if (f.Image != nil) != (i < 3) {
+			t.Errorf("frame %d: decoded %v, want %v", i, f.Image != nil, i < 3)
+		}
+	}
+}
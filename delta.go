@@ -0,0 +1,418 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"compress/flate"
+	"context"
+	"image"
+	"image/color"
+	"time"
+)
+
+// deltaEncoder rewrites an animation's frames so that each one only covers
+// what changed since the previous frame, as apngasm does.
+type deltaEncoder struct {
+	// target composites the input frames, giving the canvas that each
+	// output frame has to produce.
+	target *compositor
+	// shown composites the output frames, giving the canvas as a player
+	// displays it.
+	shown *compositor
+
+	// tolerance is the largest change in a channel, in 16-bit units, that
+	// is not written. Changes are measured from shown rather than from the
+	// previous target, so the error can't build up across frames.
+	tolerance uint16
+
+	zw    *flate.Writer
+	count byteCounter
+	row   []uint8
+	deep  bool
+	// gray restricts frames to BLEND_OP_SOURCE, so that the frames of gray
+	// input stay opaque and can be written as gray.
+	gray bool
+}
+
+// transparentPixel is a fully transparent NRGBA64 pixel.
+var transparentPixel [8]uint8
+
+// deltaBase is the canvas of a compositor as it is after disposing of the
+// last drawn frame with op.
+type deltaBase struct {
+	c  *compositor
+	op byte
+}
+
+// at returns the NRGBA64 pixel at (x, y).
+func (b deltaBase) at(x, y int) []uint8 {
+	if image.Pt(x, y).In(b.c.last) {
+		switch b.op {
+		case DISPOSE_OP_BACKGROUND:
+			return transparentPixel[:]
+		case DISPOSE_OP_PREVIOUS:
+			i := b.c.saved.PixOffset(x, y)
+			return b.c.saved.Pix[i : i+8]
+		}
+	}
+	i := b.c.canvas.PixOffset(x, y)
+	return b.c.canvas.Pix[i : i+8]
+}
+
+// samePixel reports whether two NRGBA64 pixels look the same. All fully
+// transparent pixels look the same, whatever their color.
+func samePixel(p, q []uint8) bool {
+	if p[6] == 0 && p[7] == 0 && q[6] == 0 && q[7] == 0 {
+		return true
+	}
+	return string(p[:8]) == string(q[:8])
+}
+
+// deltaFrames returns a copy of a in which every frame after the first only
+// covers the region that changed, with the DisposeOp of each frame and the
+// BlendOp of the next chosen for the smallest output. The frames of a are
+// composited first, so they may be full-canvas images or already use offsets
+// and blending. A default image is kept, converted along with the frames.
+// ctx is checked before each frame.
+func (enc *Encoder) deltaFrames(ctx context.Context, a APNG) (APNG, error) {
+	if len(a.Frames) == 0 {
+		return a, nil
+	}
+	out := APNG{LoopCount: a.LoopCount, Frames: make([]Frame, 0, len(a.Frames))}
+	frames := a.Frames
+	if frames[0].IsDefault {
+		// The default image is converted along with the other frames, so
+		// that they all end up with the same image type.
+		def := frames[0]
+		def.Image = toNRGBA64(def.Image)
+		out.Frames = append(out.Frames, def)
+		frames = frames[1:]
+	}
+	if len(frames) == 0 {
+		return a, nil
+	}
+	b := a.Frames[0].Image.Bounds()
+	d := &deltaEncoder{
+		target:    newCompositor(b.Dx(), b.Dy()),
+		shown:     newCompositor(b.Dx(), b.Dy()),
+		tolerance: uint16(enc.LossyTolerance) * 0x101,
+		deep:      !is8Bit(frames[0].Image.ColorModel()),
+		gray:      isGray(frames[0].Image.ColorModel()),
+	}
+	d.zw, _ = flate.NewWriter(&d.count, flate.BestSpeed)
+	first := len(out.Frames)
+
+	interval := enc.KeyframeInterval
+	var (
+		sinceKey int
+		elapsed  time.Duration
+	)
+	for i, f := range frames {
+		if err := ctx.Err(); err != nil {
+			return a, err
+		}
+		d.target.draw(f)
+		next := Frame{
+			DelayNumerator:   f.DelayNumerator,
+			DelayDenominator: f.DelayDenominator,
+		}
+		keyframe := i == 0 ||
+			interval.Frames > 0 && sinceKey >= interval.Frames ||
+			interval.Duration > 0 && elapsed >= interval.Duration
+		if keyframe {
+			// The first frame has to cover the whole canvas, and so do
+			// keyframes, which mustn't depend on what came before. The frame
+			// before a keyframe is left in place, as that is cheapest.
+			if i > 0 {
+				out.Frames[len(out.Frames)-1].DisposeOp = DISPOSE_OP_NONE
+				d.shown.disposeOp = DISPOSE_OP_NONE
+			}
+			next.Image, _ = d.crop(deltaBase{c: d.shown}, d.target.canvas.Rect, BLEND_OP_SOURCE)
+			if interval != (KeyframeInterval{}) {
+				out.Keyframes = append(out.Keyframes, len(out.Frames))
+			}
+			sinceKey, elapsed = 0, 0
+		} else {
+			prev := &out.Frames[len(out.Frames)-1]
+			dispose, rect, blend, m := d.best(len(out.Frames)-1 == first)
+			prev.DisposeOp = dispose
+			d.shown.disposeOp = dispose
+			next.Image = m
+			next.XOffset, next.YOffset = rect.Min.X, rect.Min.Y
+			next.BlendOp = blend
+		}
+		d.shown.draw(next)
+		out.Frames = append(out.Frames, next)
+		sinceKey++
+		elapsed += f.Duration()
+	}
+
+	convertDeltaFrames(out.Frames, frames[0].Image)
+	return out, nil
+}
+
+// best returns the DisposeOp for the last shown frame and the region, BlendOp
+// and image of the next frame that produce the target canvas with the
+// smallest compressed size.
+func (d *deltaEncoder) best(prevIsFirst bool) (dispose byte, rect image.Rectangle, blend byte, m *image.NRGBA64) {
+	bestSize := -1
+	for _, op := range []byte{DISPOSE_OP_NONE, DISPOSE_OP_BACKGROUND, DISPOSE_OP_PREVIOUS} {
+		if op == DISPOSE_OP_PREVIOUS && prevIsFirst {
+			// The first frame can't be reverted, see compositor.draw.
+			continue
+		}
+		base := deltaBase{c: d.shown, op: op}
+		r := d.diffRect(base)
+		if r.Empty() {
+			// Nothing changed, but a frame can't be empty.
+			r = image.Rect(0, 0, 1, 1)
+		}
+		for _, bo := range []byte{BLEND_OP_SOURCE, BLEND_OP_OVER} {
+			if bo == BLEND_OP_OVER && d.gray {
+				continue
+			}
+			cm, ok := d.crop(base, r, bo)
+			if !ok {
+				continue
+			}
+			if size := d.size(cm); bestSize < 0 || size < bestSize {
+				bestSize = size
+				dispose, rect, blend, m = op, r, bo, cm
+			}
+		}
+	}
+	return dispose, rect, blend, m
+}
+
+// diffRect returns the smallest rectangle holding every pixel that differs
+// between base and the target canvas.
+func (d *deltaEncoder) diffRect(base deltaBase) image.Rectangle {
+	t := d.target.canvas
+	r := image.Rectangle{Min: t.Rect.Max, Max: t.Rect.Min}
+	for y := t.Rect.Min.Y; y < t.Rect.Max.Y; y++ {
+		i := t.PixOffset(t.Rect.Min.X, y)
+		for x := t.Rect.Min.X; x < t.Rect.Max.X; x++ {
+			if !similarPixel(base.at(x, y), t.Pix[i:i+8], d.tolerance) {
+				if x < r.Min.X {
+					r.Min.X = x
+				}
+				if x >= r.Max.X {
+					r.Max.X = x + 1
+				}
+				if y < r.Min.Y {
+					r.Min.Y = y
+				}
+				r.Max.Y = y + 1
+			}
+			i += 8
+		}
+	}
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+	return r
+}
+
+// crop returns the part of the target canvas within r, as a frame to draw
+// over base with the given BlendOp. With BLEND_OP_OVER, unchanged pixels are
+// made transparent, which is only possible if every changed pixel is either
+// opaque or drawn over a transparent one. With BLEND_OP_SOURCE, pixels within
+// the tolerance keep their color in base.
+func (d *deltaEncoder) crop(base deltaBase, r image.Rectangle, blend byte) (*image.NRGBA64, bool) {
+	t := d.target.canvas
+	m := image.NewNRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := t.PixOffset(r.Min.X, y)
+		j := m.PixOffset(0, y-r.Min.Y)
+		if blend == BLEND_OP_SOURCE && d.tolerance == 0 {
+			copy(m.Pix[j:j+r.Dx()*8], t.Pix[i:i+r.Dx()*8])
+			continue
+		}
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p, q := base.at(x, y), t.Pix[i:i+8]
+			switch {
+			case blend == BLEND_OP_SOURCE && similarPixel(p, q, d.tolerance):
+				copy(m.Pix[j:j+8], p)
+			case blend == BLEND_OP_SOURCE:
+				copy(m.Pix[j:j+8], q)
+			case !similarPixel(p, q, d.tolerance):
+				if (q[6] != 0xff || q[7] != 0xff) && (p[6] != 0 || p[7] != 0) {
+					return nil, false
+				}
+				copy(m.Pix[j:j+8], q)
+			}
+			i += 8
+			j += 8
+		}
+	}
+	return m, true
+}
+
+// size estimates the compressed size of m, in the bit depth it will be
+// written with.
+func (d *deltaEncoder) size(m *image.NRGBA64) int {
+	d.count = 0
+	d.zw.Reset(&d.count)
+	for y := 0; y < m.Rect.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+m.Rect.Dx()*8]
+		if !d.deep {
+			d.row = d.row[:0]
+			for i := 0; i < len(row); i += 2 {
+				d.row = append(d.row, row[i])
+			}
+			row = d.row
+		}
+		d.zw.Write(row)
+	}
+	d.zw.Close()
+	return int(d.count)
+}
+
+// toNRGBA64 returns a copy of m as an *image.NRGBA64 with its origin at (0, 0).
+func toNRGBA64(m image.Image) *image.NRGBA64 {
+	b := m.Bounds()
+	n := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	var buf [8]uint8
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			i := n.PixOffset(x, y)
+			copy(n.Pix[i:i+8], pixelNRGBA64(m, b.Min.X+x, b.Min.Y+y, buf[:]))
+		}
+	}
+	return n
+}
+
+// is8Bit reports whether colors of the model fit in 8 bits per channel.
+func is8Bit(m color.Model) bool {
+	switch m {
+	case color.AlphaModel, color.GrayModel, color.NRGBAModel, color.RGBAModel:
+		return true
+	}
+	_, ok := m.(color.Palette)
+	return ok
+}
+
+// isGray reports whether m is one of the gray color models.
+func isGray(m color.Model) bool {
+	return m == color.GrayModel || m == color.Gray16Model
+}
+
+// convertDeltaFrames converts the NRGBA64 images of frames to the smallest
+// type that suits the original first frame: paletted if it was paletted and
+// every color is in its palette, gray if it was gray and every pixel is
+// opaque gray, and 8-bit if it was 8-bit. Channels are rounded to 8 bits,
+// so that colors that went through 16 bits come back as they were.
+func convertDeltaFrames(frames []Frame, orig image.Image) {
+	if pal, ok := orig.ColorModel().(color.Palette); ok {
+		if _, ok := orig.(image.PalettedImage); ok {
+			if convertToPaletted(frames, pal) {
+				return
+			}
+		}
+	}
+	if isGray(orig.ColorModel()) && convertToGray(frames, orig.ColorModel() == color.Gray16Model) {
+		return
+	}
+	if !is8Bit(orig.ColorModel()) {
+		return
+	}
+	for i, f := range frames {
+		src := f.Image.(*image.NRGBA64)
+		m := image.NewNRGBA(src.Rect)
+		for j := range m.Pix {
+			m.Pix[j] = to8Bit(src.Pix[2*j], src.Pix[2*j+1])
+		}
+		frames[i].Image = m
+	}
+}
+
+// to8Bit returns the 16-bit value with the bytes hi and lo rounded to 8
+// bits.
+func to8Bit(hi, lo uint8) uint8 {
+	return uint8(((uint32(hi)<<8|uint32(lo))*0xff + 0x7fff) / 0xffff)
+}
+
+// convertToGray converts the NRGBA64 images of frames to gray images, of
+// 16 bits if deep is set and 8 bits otherwise. It reports false, leaving
+// frames unchanged, if a pixel isn't opaque gray.
+func convertToGray(frames []Frame, deep bool) bool {
+	for _, f := range frames {
+		pix := f.Image.(*image.NRGBA64).Pix
+		for j := 0; j < len(pix); j += 8 {
+			if pix[j+6] != 0xff || pix[j+7] != 0xff ||
+				pix[j] != pix[j+2] || pix[j] != pix[j+4] ||
+				pix[j+1] != pix[j+3] || pix[j+1] != pix[j+5] {
+				return false
+			}
+		}
+	}
+	for i, f := range frames {
+		src := f.Image.(*image.NRGBA64)
+		if deep {
+			m := image.NewGray16(src.Rect)
+			for j := range m.Pix {
+				m.Pix[j] = src.Pix[j/2*8+j%2]
+			}
+			frames[i].Image = m
+		} else {
+			m := image.NewGray(src.Rect)
+			for j := range m.Pix {
+				m.Pix[j] = to8Bit(src.Pix[8*j], src.Pix[8*j+1])
+			}
+			frames[i].Image = m
+		}
+	}
+	return true
+}
+
+// convertToPaletted converts the NRGBA64 images of frames to paletted images
+// using pal, adding a transparent color to it if needed. It reports false,
+// leaving frames unchanged, if a color isn't in the palette.
+func convertToPaletted(frames []Frame, pal color.Palette) bool {
+	index := make(map[color.NRGBA64]uint8, len(pal))
+	transparent := -1
+	for i := len(pal) - 1; i >= 0; i-- {
+		c := color.NRGBA64Model.Convert(pal[i]).(color.NRGBA64)
+		index[c] = uint8(i)
+		if c.A == 0 {
+			transparent = i
+		}
+	}
+	if transparent < 0 {
+		if len(pal) == 256 {
+			return false
+		}
+		transparent = len(pal)
+		pal = append(pal[:len(pal):len(pal)], color.NRGBA{})
+	}
+	images := make([]*image.Paletted, len(frames))
+	for i, f := range frames {
+		src := f.Image.(*image.NRGBA64)
+		m := image.NewPaletted(src.Rect, pal)
+		for j := range m.Pix {
+			p := src.Pix[8*j : 8*j+8]
+			c := color.NRGBA64{
+				R: uint16(p[0])<<8 | uint16(p[1]),
+				G: uint16(p[2])<<8 | uint16(p[3]),
+				B: uint16(p[4])<<8 | uint16(p[5]),
+				A: uint16(p[6])<<8 | uint16(p[7]),
+			}
+			if c.A == 0 {
+				m.Pix[j] = uint8(transparent)
+				continue
+			}
+			idx, ok := index[c]
+			if !ok {
+				return false
+			}
+			m.Pix[j] = idx
+		}
+		images[i] = m
+	}
+	for i, m := range images {
+		frames[i].Image = m
+	}
+	return true
+}
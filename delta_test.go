@@ -0,0 +1,309 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// movingSquare returns n full-canvas frames of a square moving over a
+// gradient, made with newImage.
+func movingSquare(n int, newImage func(r image.Rectangle) image.Image) APNG {
+	var a APNG
+	for i := 0; i < n; i++ {
+		m := newImage(image.Rect(0, 0, 64, 48))
+		set := m.(interface{ Set(x, y int, c color.Color) })
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				c := color.NRGBA{uint8(x * 4), uint8(y * 4), 0x80, 0xff}
+				if x >= 8+i*4 && x < 16+i*4 && y >= 10 && y < 18 {
+					c = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+				}
+				if i%2 == 1 && x < 4 && y < 4 {
+					c = color.NRGBA{}
+				}
+				set.Set(x, y, c)
+			}
+		}
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNumerator: uint16(i + 1)})
+	}
+	return a
+}
+
+// composite returns the canvas after each frame of a.
+func composite(a APNG) []*image.NRGBA64 {
+	b := a.Frames[0].Image.Bounds()
+	c := newCompositor(b.Dx(), b.Dy())
+	var canvases []*image.NRGBA64
+	for _, f := range a.Frames {
+		if f.IsDefault {
+			continue
+		}
+		c.draw(f)
+		m := image.NewNRGBA64(c.canvas.Rect)
+		copy(m.Pix, c.canvas.Pix)
+		canvases = append(canvases, m)
+	}
+	return canvases
+}
+
+func TestDeltaFrames(t *testing.T) {
+	newImages := map[string]func(r image.Rectangle) image.Image{
+		"nrgba":   func(r image.Rectangle) image.Image { return image.NewNRGBA(r) },
+		"nrgba64": func(r image.Rectangle) image.Image { return image.NewNRGBA64(r) },
+	}
+	for name, newImage := range newImages {
+		t.Run(name, func(t *testing.T) {
+			a := movingSquare(8, newImage)
+			var full, delta bytes.Buffer
+			if err := Encode(&full, a); err != nil {
+				t.Fatal(err)
+			}
+			enc := &Encoder{DeltaFrames: true}
+			if err := enc.Encode(&delta, a); err != nil {
+				t.Fatal(err)
+			}
+			if delta.Len() >= full.Len() {
+				t.Errorf("delta encoding is %d bytes, not smaller than %d", delta.Len(), full.Len())
+			}
+
+			b, err := DecodeAll(&delta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b.Frames) != len(a.Frames) {
+				t.Fatalf("got %d frames, want %d", len(b.Frames), len(a.Frames))
+			}
+			for i, f := range b.Frames {
+				if f.DelayNumerator != a.Frames[i].DelayNumerator {
+					t.Errorf("frame %d: delay %d, want %d", i, f.DelayNumerator, a.Frames[i].DelayNumerator)
+				}
+				if i > 0 && f.Image.Bounds().Dx() >= 64 {
+					t.Errorf("frame %d: not cropped, bounds %v", i, f.Image.Bounds())
+				}
+			}
+			want, got := composite(a), composite(b)
+			for i := range want {
+				if err := diff(want[i], got[i]); err != nil {
+					t.Errorf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaFramesPaletted(t *testing.T) {
+	pal := color.Palette{
+		color.NRGBA{0x00, 0x00, 0x00, 0xff},
+		color.NRGBA{0xff, 0x00, 0x00, 0xff},
+		color.NRGBA{0x00, 0x00, 0xff, 0xff},
+	}
+	a := APNG{}
+	for i := 0; i < 4; i++ {
+		m := image.NewPaletted(image.Rect(0, 0, 16, 16), pal)
+		for y := 4; y < 8; y++ {
+			m.SetColorIndex(i*4, y, 1)
+			m.SetColorIndex(i*4+1, y, 2)
+		}
+		a.Frames = append(a.Frames, Frame{Image: m})
+	}
+	// A default image, which is not part of the animation.
+	def := image.NewPaletted(image.Rect(0, 0, 16, 16), pal)
+	a.Frames = append([]Frame{{Image: def, IsDefault: true}}, a.Frames...)
+
+	var buf bytes.Buffer
+	enc := &Encoder{DeltaFrames: true}
+	if err := enc.Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Frames[0].IsDefault {
+		t.Fatal("default image was lost")
+	}
+	for i, f := range b.Frames {
+		if _, ok := f.Image.(*image.Paletted); !ok {
+			t.Errorf("frame %d: got %T, want *image.Paletted", i, f.Image)
+		}
+	}
+	if err := diff(def, b.Frames[0].Image); err != nil {
+		t.Errorf("default image: %v", err)
+	}
+	want, got := composite(a), composite(b)
+	for i := range want {
+		if err := diff(want[i], got[i]); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestDeltaFramesGray(t *testing.T) {
+	for _, test := range []struct {
+		newImage func(r image.Rectangle) image.Image
+		want     string
+	}{
+		{func(r image.Rectangle) image.Image { return image.NewGray(r) }, "*image.Gray"},
+		{func(r image.Rectangle) image.Image { return image.NewGray16(r) }, "*image.Gray16"},
+	} {
+		a := movingSquare(6, test.newImage)
+		var plain, delta bytes.Buffer
+		if err := Encode(&plain, a); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Encoder{DeltaFrames: true}).Encode(&delta, a); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() > plain.Len() {
+			t.Errorf("%s: delta frames take %d bytes, more than %d without", test.want, delta.Len(), plain.Len())
+		}
+		b, err := DecodeAll(&delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range b.Frames {
+			if got := fmt.Sprintf("%T", f.Image); got != test.want {
+				t.Errorf("frame %d: got %s, want %s", i, got, test.want)
+			}
+		}
+		want, got := composite(a), composite(b)
+		for i := range want {
+			if err := diff(want[i], got[i]); err != nil {
+				t.Errorf("%s: frame %d: %v", test.want, i, err)
+			}
+		}
+	}
+}
+
+func TestConvertDeltaFramesRounds(t *testing.T) {
+	m := image.NewNRGBA64(image.Rect(0, 0, 3, 1))
+	m.SetNRGBA64(0, 0, color.NRGBA64{0x10ff, 0x807f, 0x8080, 0xffff})
+	m.SetNRGBA64(1, 0, color.NRGBA64{0x8080, 0x8080, 0x8080, 0xffff})
+	m.SetNRGBA64(2, 0, color.NRGBA64{0x0080, 0xff7f, 0, 0x7fff})
+	frames := []Frame{{Image: m}}
+	convertDeltaFrames(frames, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	got := frames[0].Image.(*image.NRGBA).Pix
+	want := []uint8{0x11, 0x80, 0x80, 0xff, 0x80, 0x80, 0x80, 0xff, 0x00, 0xff, 0x00, 0x7f}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	// Gray input stays gray, rounded the same way.
+	frames = []Frame{{Image: image.NewNRGBA64(image.Rect(0, 0, 1, 1))}}
+	frames[0].Image.(*image.NRGBA64).SetNRGBA64(0, 0, color.NRGBA64{0x10ff, 0x10ff, 0x10ff, 0xffff})
+	convertDeltaFrames(frames, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if g, ok := frames[0].Image.(*image.Gray); !ok || g.Pix[0] != 0x11 {
+		t.Errorf("got %#v, want a gray image of 0x11", frames[0].Image)
+	}
+}
+
+func TestLossyTolerance(t *testing.T) {
+	const tolerance = 4
+	// A gradient that slowly brightens, one step per frame, with a square
+	// moving over it. Without tracking what is displayed, skipping each
+	// small step would let the error grow.
+	var a APNG
+	for i := 0; i < 20; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				c := color.NRGBA{uint8(x*4 + i), uint8(y*4 + i), 0x40, 0xff}
+				if x >= i && x < i+4 && y >= 8 && y < 12 {
+					c = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+				}
+				m.SetNRGBA(x, y, c)
+			}
+		}
+		a.Frames = append(a.Frames, Frame{Image: m})
+	}
+
+	var exact, lossy bytes.Buffer
+	if err := (&Encoder{DeltaFrames: true}).Encode(&exact, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Encoder{LossyTolerance: tolerance}).Encode(&lossy, a); err != nil {
+		t.Fatal(err)
+	}
+	if lossy.Len() >= exact.Len() {
+		t.Errorf("lossy encoding is %d bytes, not smaller than %d", lossy.Len(), exact.Len())
+	}
+	b, err := DecodeAll(&lossy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := composite(a), composite(b)
+	for i := range want {
+		if !similarImages(want[i], got[i], tolerance*0x101) {
+			t.Errorf("frame %d: differs by more than %d", i, tolerance)
+		}
+	}
+}
+
+func TestKeyframeInterval(t *testing.T) {
+	tests := []struct {
+		interval    KeyframeInterval
+		withDefault bool
+		keyframes   []int
+	}{
+		{KeyframeInterval{Frames: 3}, false, []int{0, 3, 6}},
+		{KeyframeInterval{Frames: 3}, true, []int{1, 4, 7}},
+		// The delays are 10ms, 20ms, 30ms and so on.
+		{KeyframeInterval{Duration: 50 * time.Millisecond}, false, []int{0, 3, 5, 6, 7}},
+		{KeyframeInterval{Frames: 2, Duration: 50 * time.Millisecond}, false, []int{0, 2, 4, 5, 6, 7}},
+	}
+	for _, test := range tests {
+		a := movingSquare(8, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+		if test.withDefault {
+			a.Frames = append([]Frame{{Image: a.Frames[0].Image, IsDefault: true}}, a.Frames...)
+		}
+		var buf bytes.Buffer
+		if err := (&Encoder{KeyframeInterval: test.interval}).Encode(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+		b, err := DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(b.Keyframes) != fmt.Sprint(test.keyframes) {
+			t.Errorf("%+v: got keyframes %v, want %v", test.interval, b.Keyframes, test.keyframes)
+		}
+		for _, k := range b.Keyframes {
+			f := b.Frames[k]
+			if f.Image.Bounds().Dx() != 64 || f.Image.Bounds().Dy() != 48 || f.XOffset != 0 || f.YOffset != 0 || f.BlendOp != BLEND_OP_SOURCE {
+				t.Errorf("%+v: keyframe %d doesn't cover the canvas with BLEND_OP_SOURCE", test.interval, k)
+			}
+			if k > 0 && !b.Frames[k-1].IsDefault && b.Frames[k-1].DisposeOp != DISPOSE_OP_NONE {
+				t.Errorf("%+v: frame before keyframe %d has DisposeOp %d", test.interval, k, b.Frames[k-1].DisposeOp)
+			}
+		}
+		want, got := composite(a), composite(b)
+		for i := range want {
+			if err := diff(want[i], got[i]); err != nil {
+				t.Errorf("%+v: frame %d: %v", test.interval, i, err)
+			}
+		}
+	}
+}
+
+func TestEncodeBadKeyframes(t *testing.T) {
+	a := movingSquare(4, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	a.Frames[1].BlendOp = BLEND_OP_OVER
+	a.Frames[2].Image = a.Frames[2].Image.(*image.NRGBA).SubImage(image.Rect(0, 0, 32, 48))
+	for _, keyframes := range [][]int{{-1}, {4}, {1}, {2}} {
+		a.Keyframes = keyframes
+		var buf bytes.Buffer
+		if err := Encode(&buf, a); err == nil {
+			t.Errorf("keyframes %v: got nil error, want non-nil", keyframes)
+		} else if buf.Len() > 0 {
+			t.Errorf("keyframes %v: wrote %d bytes before the error", keyframes, buf.Len())
+		}
+	}
+}
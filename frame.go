@@ -6,6 +6,8 @@ package apng
 
 import (
 	"image"
+	"math/big"
+	"time"
 )
 
 // dispose_op values, as per the APNG spec.
@@ -25,6 +27,10 @@ type Frame struct {
 	Image            image.Image
 	width, height    int
 	XOffset, YOffset int
+	// DelayNumerator and DelayDenominator give the number of seconds the
+	// frame is shown as a fraction. A DelayDenominator of 0 means 100, as
+	// per the APNG spec, so that the numerator counts hundredths of a
+	// second.
 	DelayNumerator   uint16
 	DelayDenominator uint16
 	DisposeOp        byte
@@ -45,3 +51,108 @@ func (f *Frame) GetDelay() float64 {
 	}
 	return float64(f.DelayNumerator) / float64(d)
 }
+
+// Duration returns how long the frame is shown, rounded to the nearest
+// nanosecond.
+func (f *Frame) Duration() time.Duration {
+	d := int64(f.DelayDenominator)
+	if d == 0 {
+		d = 100
+	}
+	return time.Duration((int64(f.DelayNumerator)*int64(time.Second) + d/2) / d)
+}
+
+// SetDuration sets DelayNumerator and DelayDenominator to the fraction of a
+// second closest to d that fits in them. Durations below 0 are set as 0, and
+// durations above 65535 seconds as 65535 seconds. The DelayDenominator set
+// is never 0.
+func (f *Frame) SetDuration(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	num, den, ok := delayFraction(big.NewRat(int64(d), int64(time.Second)))
+	if !ok {
+		num, den = 0xffff, 1
+	}
+	f.DelayNumerator, f.DelayDenominator = num, den
+}
+
+// delayRat returns the delay of f in seconds as an exact fraction.
+func (f *Frame) delayRat() *big.Rat {
+	d := int64(f.DelayDenominator)
+	if d == 0 {
+		d = 100
+	}
+	return big.NewRat(int64(f.DelayNumerator), d)
+}
+
+// exactDelayFraction returns r as a fraction whose numerator and denominator
+// both fit in a uint16, and reports false if there is none.
+func exactDelayFraction(r *big.Rat) (num, den uint16, ok bool) {
+	const limit = 0xffff
+	if r.Sign() < 0 || !r.Num().IsUint64() || !r.Denom().IsUint64() || r.Num().Uint64() > limit || r.Denom().Uint64() > limit {
+		return 0, 0, false
+	}
+	return uint16(r.Num().Uint64()), uint16(r.Denom().Uint64()), true
+}
+
+// delayFraction returns the fraction closest to r whose numerator and
+// denominator both fit in a uint16. It reports false if r is larger than
+// 65535 seconds.
+func delayFraction(r *big.Rat) (num, den uint16, ok bool) {
+	const limit = 0xffff
+	if r.Sign() < 0 || r.Cmp(big.NewRat(limit, 1)) > 0 {
+		return 0, 0, false
+	}
+	if num, den, ok := exactDelayFraction(r); ok {
+		return num, den, true
+	}
+	// Walk the convergents of r's continued fraction until the next one no
+	// longer fits, then pick between the last convergent and the largest
+	// semiconvergent that fits.
+	var (
+		p0, q0 uint64 = 0, 1
+		p1, q1 uint64 = 1, 0
+		x             = new(big.Rat).Set(r)
+		a             = new(big.Int)
+	)
+	for {
+		a.Quo(x.Num(), x.Denom())
+		t := uint64(limit + 1)
+		if a.IsUint64() && a.Uint64() < t {
+			t = a.Uint64()
+		}
+		p2, q2 := t*p1+p0, t*q1+q0
+		if p2 > limit || q2 > limit {
+			// The largest semiconvergent that fits.
+			t = limit
+			if p1 > 0 {
+				t = (limit - p0) / p1
+			}
+			if q1 > 0 && (limit-q0)/q1 < t {
+				t = (limit - q0) / q1
+			}
+			p2, q2 = t*p1+p0, t*q1+q0
+			if t > 0 && closer(r, p2, q2, p1, q1) {
+				p1, q1 = p2, q2
+			}
+			break
+		}
+		p0, q0, p1, q1 = p1, q1, p2, q2
+		x.Sub(x, new(big.Rat).SetInt(a))
+		if x.Sign() == 0 {
+			break
+		}
+		x.Inv(x)
+	}
+	return uint16(p1), uint16(q1), true
+}
+
+// closer reports whether p0/q0 is strictly closer to r than p1/q1.
+func closer(r *big.Rat, p0, q0, p1, q1 uint64) bool {
+	d0 := new(big.Rat).SetFrac(new(big.Int).SetUint64(p0), new(big.Int).SetUint64(q0))
+	d1 := new(big.Rat).SetFrac(new(big.Int).SetUint64(p1), new(big.Int).SetUint64(q1))
+	d0.Sub(d0, r)
+	d1.Sub(d1, r)
+	return d0.Abs(d0).Cmp(d1.Abs(d1)) < 0
+}
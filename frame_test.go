@@ -0,0 +1,104 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameDuration(t *testing.T) {
+	tests := []struct {
+		num, den uint16
+		d        time.Duration
+	}{
+		{0, 0, 0},
+		{5, 0, 50 * time.Millisecond},
+		{1, 100, 10 * time.Millisecond},
+		{1, 3, 333333333},
+		{2, 3, 666666667},
+		{65535, 1, 65535 * time.Second},
+	}
+	for _, test := range tests {
+		f := Frame{DelayNumerator: test.num, DelayDenominator: test.den}
+		if d := f.Duration(); d != test.d {
+			t.Errorf("%d/%d: got %v, want %v", test.num, test.den, d, test.d)
+		}
+	}
+}
+
+func TestFrameSetDuration(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		num, den uint16
+	}{
+		{0, 0, 1},
+		{-time.Second, 0, 1},
+		{40 * time.Millisecond, 1, 25},
+		{time.Second / 3, 1, 3},
+		{1500 * time.Millisecond, 3, 2},
+		{65535 * time.Second, 65535, 1},
+		{70000 * time.Second, 65535, 1},
+		// No fraction that fits is closer to 1ns than 0.
+		{time.Nanosecond, 0, 1},
+	}
+	for _, test := range tests {
+		var f Frame
+		f.SetDuration(test.d)
+		if f.DelayNumerator != test.num || f.DelayDenominator != test.den {
+			t.Errorf("%v: got %d/%d, want %d/%d", test.d, f.DelayNumerator, f.DelayDenominator, test.num, test.den)
+		}
+	}
+}
+
+func TestFrameAt(t *testing.T) {
+	ms := time.Millisecond
+	a := APNG{Frames: []Frame{
+		{IsDefault: true},
+		{DelayNumerator: 10, DelayDenominator: 1000},
+		{DelayNumerator: 0},
+		{DelayNumerator: 2}, // 20ms, as the denominator is 100.
+		{DelayNumerator: 30, DelayDenominator: 1000},
+	}}
+	if d := a.TotalDuration(); d != 60*ms {
+		t.Fatalf("got total duration %v, want %v", d, 60*ms)
+	}
+	tests := []struct {
+		loopCount uint
+		t         time.Duration
+		frame     int
+	}{
+		{0, -ms, 1},
+		{0, 0, 1},
+		{0, 9 * ms, 1},
+		{0, 10 * ms, 3},
+		{0, 29 * ms, 3},
+		{0, 30 * ms, 4},
+		{0, 59 * ms, 4},
+		{0, 60 * ms, 1},
+		{0, 600*ms + 15*ms, 3},
+		{1, 59 * ms, 4},
+		{1, 60 * ms, 4},
+		{2, 75 * ms, 3},
+		{2, 120 * ms, 4},
+		{2, time.Hour, 4},
+	}
+	for _, test := range tests {
+		a.LoopCount = test.loopCount
+		if i := a.FrameAt(test.t); i != test.frame {
+			t.Errorf("LoopCount %d, %v: got frame %d, want %d", test.loopCount, test.t, i, test.frame)
+		}
+	}
+
+	if i := (&APNG{}).FrameAt(0); i != -1 {
+		t.Errorf("no frames: got frame %d, want -1", i)
+	}
+	if i := (&APNG{Frames: []Frame{{IsDefault: true}}}).FrameAt(0); i != 0 {
+		t.Errorf("only a default image: got frame %d, want 0", i)
+	}
+	if i := (&APNG{Frames: []Frame{{}, {}}}).FrameAt(time.Second); i != 1 {
+		t.Errorf("no delays: got frame %d, want 1", i)
+	}
+}
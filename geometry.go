@@ -0,0 +1,405 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/big"
+	"strconv"
+)
+
+// Crop returns a copy of a whose canvas is only the region r of a's canvas.
+// Frames are clipped to r and their offsets moved to match. Frames that are
+// entirely outside r are dropped. A dropped frame's delay is added to the
+// frame before it if that frame is left in place, with DISPOSE_OP_NONE, and
+// its delay fits. Otherwise the dropped frame is replaced by a 1x1 frame of
+// the first frame's type that redraws a pixel of the canvas as it is once
+// the frame before is disposed of, so that it is still disposed of when it
+// was. A paletted placeholder may add the pixel's color to the first
+// frame's palette. If the first frame's type can't show any pixel of the
+// canvas, as when a Gray canvas has been cleared, the delay is added to the
+// frame before after all. The frames share their images with a. It returns
+// an error if r is empty or not within the canvas.
+func Crop(a APNG, r image.Rectangle) (APNG, error) {
+	if len(a.Frames) == 0 {
+		return a, nil
+	}
+	b := a.Frames[0].Image.Bounds()
+	canvas := image.Rect(0, 0, b.Dx(), b.Dy())
+	if r.Empty() || !r.In(canvas) {
+		return a, FormatError("crop rectangle " + r.String() + " is not within the canvas " + canvas.String())
+	}
+	out := APNG{LoopCount: a.LoopCount}
+	// c composites out as it is built, for the placeholders.
+	c := newCompositor(r.Dx(), r.Dy())
+	// pal is the palette the frames are encoded with, if any, as the
+	// Encoder takes it from the first frame.
+	var pal color.Palette
+	if _, ok := a.Frames[0].Image.(image.PalettedImage); ok {
+		pal, _ = a.Frames[0].Image.ColorModel().(color.Palette)
+	}
+	colors := len(pal)
+	// index maps the indices of a's frames to those of out's.
+	index := make([]int, len(a.Frames))
+	for i, f := range a.Frames {
+		fb := f.Image.Bounds()
+		fr := image.Rect(f.XOffset, f.YOffset, f.XOffset+fb.Dx(), f.YOffset+fb.Dy())
+		clip := fr.Intersect(r)
+		if clip.Empty() {
+			index[i] = -1
+			// The first frame covers the whole canvas, so there is always a
+			// frame before this one.
+			prev := &out.Frames[len(out.Frames)-1]
+			delay := new(big.Rat).Add(prev.delayRat(), f.delayRat())
+			if prev.DisposeOp == DISPOSE_OP_NONE {
+				if num, den, ok := delayFraction(delay); ok {
+					prev.DelayNumerator, prev.DelayDenominator = num, den
+					continue
+				}
+			}
+			c.dispose()
+			p, ok := placeholder(a.Frames[0].Image, c.canvas, &pal)
+			if !ok {
+				num, den, ok := delayFraction(delay)
+				if !ok {
+					num, den = 0xffff, 1
+				}
+				prev.DelayNumerator, prev.DelayDenominator = num, den
+				continue
+			}
+			p.DelayNumerator, p.DelayDenominator = f.DelayNumerator, f.DelayDenominator
+			c.draw(p)
+			out.Frames = append(out.Frames, p)
+			continue
+		}
+		f.Image = subImage(f.Image, clip.Sub(fr.Min).Add(fb.Min))
+		f.XOffset, f.YOffset = clip.Min.X-r.Min.X, clip.Min.Y-r.Min.Y
+		if !f.IsDefault {
+			c.draw(f)
+		}
+		index[i] = len(out.Frames)
+		out.Frames = append(out.Frames, f)
+	}
+	if len(pal) > colors {
+		out.Frames[0].Image = withPalette(out.Frames[0].Image, pal)
+	}
+	for _, k := range a.Keyframes {
+		if k >= 0 && k < len(index) && index[k] >= 0 {
+			out.Keyframes = append(out.Keyframes, index[k])
+		}
+	}
+	return out, nil
+}
+
+// placeholder returns a 1x1 frame of the same type as first that leaves
+// canvas unchanged, by redrawing one of its pixels. If *pal is not nil,
+// the frame is paletted, and the color of the top left pixel is added to
+// *pal if no pixel has a color in it. It returns false if there is no such
+// frame.
+func placeholder(first image.Image, canvas *image.NRGBA64, pal *color.Palette) (Frame, bool) {
+	r := image.Rect(0, 0, 1, 1)
+	// same reports whether two colors look the same on the canvas.
+	same := func(a, b color.NRGBA64) bool {
+		return a == b || a.A == 0 && b.A == 0
+	}
+	frame := func(m image.Image, x, y int, c color.NRGBA64) Frame {
+		f := Frame{Image: m, XOffset: x, YOffset: y, BlendOp: BLEND_OP_SOURCE}
+		if c.A == 0 {
+			f.BlendOp = BLEND_OP_OVER
+		}
+		return f
+	}
+	b := canvas.Bounds()
+	if *pal != nil {
+		entries := make([]color.NRGBA64, len(*pal))
+		for i, c := range *pal {
+			entries[i] = color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := canvas.NRGBA64At(x, y)
+				for i, e := range entries {
+					if same(c, e) {
+						m := image.NewPaletted(r, *pal)
+						m.Pix[0] = uint8(i)
+						return frame(m, x, y, c), true
+					}
+				}
+			}
+		}
+		if len(*pal) >= 256 {
+			return Frame{}, false
+		}
+		// Reslice so as not to write to the first frame's palette.
+		c := canvas.NRGBA64At(b.Min.X, b.Min.Y)
+		*pal = append((*pal)[:len(*pal):len(*pal)], color.NRGBAModel.Convert(c))
+		m := image.NewPaletted(r, *pal)
+		m.Pix[0] = uint8(len(*pal) - 1)
+		return frame(m, b.Min.X, b.Min.Y, c), true
+	}
+	m, ok := newImageLike(first, r).(draw.Image)
+	if !ok {
+		return Frame{}, false
+	}
+	var buf [8]uint8
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := canvas.NRGBA64At(x, y)
+			m.Set(0, 0, c)
+			p := pixelNRGBA64(m, 0, 0, buf[:])
+			got := color.NRGBA64{
+				uint16(p[0])<<8 | uint16(p[1]), uint16(p[2])<<8 | uint16(p[3]),
+				uint16(p[4])<<8 | uint16(p[5]), uint16(p[6])<<8 | uint16(p[7]),
+			}
+			if same(c, got) {
+				return frame(m, x, y, c), true
+			}
+		}
+	}
+	return Frame{}, false
+}
+
+// withPalette returns m, a PalettedImage, with the palette pal, which
+// extends its own.
+func withPalette(m image.Image, pal color.Palette) image.Image {
+	if p, ok := m.(*image.Paletted); ok {
+		q := *p
+		q.Palette = pal
+		return &q
+	}
+	pm := m.(image.PalettedImage)
+	b := m.Bounds()
+	q := image.NewPaletted(b, pal)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			q.SetColorIndex(x, y, pm.ColorIndexAt(x, y))
+		}
+	}
+	return q
+}
+
+// Pad returns a copy of a with transparent margins of the given widths
+// added around its canvas. The offsets of the frames are moved to match.
+// The default image, the first frame and keyframes, which cover the whole
+// canvas, are extended with transparent pixels, and converted to the
+// smallest type that suits them, as with the Encoder's DeltaFrames. The
+// other frames share their images with a.
+func Pad(a APNG, left, top, right, bottom int) (APNG, error) {
+	if left < 0 || top < 0 || right < 0 || bottom < 0 {
+		return a, FormatError("invalid padding: " + strconv.Itoa(left) + ", " + strconv.Itoa(top) + ", " + strconv.Itoa(right) + ", " + strconv.Itoa(bottom))
+	}
+	if len(a.Frames) == 0 || left == 0 && top == 0 && right == 0 && bottom == 0 {
+		return a, nil
+	}
+	b := a.Frames[0].Image.Bounds()
+	canvas := image.Rect(0, 0, left+b.Dx()+right, top+b.Dy()+bottom)
+	out := APNG{LoopCount: a.LoopCount, Keyframes: append([]int(nil), a.Keyframes...)}
+	out.Frames = make([]Frame, len(a.Frames))
+	full := make(map[int]bool, len(a.Keyframes)+2)
+	full[0] = true
+	if a.Frames[0].IsDefault {
+		full[1] = true
+	}
+	for _, k := range a.Keyframes {
+		full[k] = true
+	}
+	var extended []Frame
+	for i, f := range a.Frames {
+		if full[i] {
+			m := image.NewNRGBA64(canvas)
+			copyRect(m, image.Rect(left, top, left+b.Dx(), top+b.Dy()), toNRGBA64(f.Image), image.Point{})
+			f.Image = m
+			extended = append(extended, f)
+		} else {
+			f.XOffset += left
+			f.YOffset += top
+		}
+		out.Frames[i] = f
+	}
+	convertDeltaFrames(extended, animationFrames(a)[0].Image)
+	for i, j := 0, 0; i < len(out.Frames); i++ {
+		if full[i] {
+			out.Frames[i].Image = extended[j].Image
+			j++
+		}
+	}
+	return out, nil
+}
+
+// Rotate returns a copy of a rotated clockwise by the given number of
+// degrees, which must be a multiple of 90. The frames' offsets and sizes
+// are remapped exactly, so that each frame still covers only what it did,
+// and their images are rotated. Images of the image package's types with a
+// Pix slice keep their type, and others become *image.NRGBA64.
+func Rotate(a APNG, degrees int) (APNG, error) {
+	if degrees%90 != 0 {
+		return a, UnsupportedError("rotation by " + strconv.Itoa(degrees) + " degrees")
+	}
+	switch (degrees%360 + 360) % 360 {
+	case 90:
+		return orient(a, true, func(x, y, w, h int) (int, int) { return h - 1 - y, x }), nil
+	case 180:
+		return orient(a, false, func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y }), nil
+	case 270:
+		return orient(a, true, func(x, y, w, h int) (int, int) { return y, w - 1 - x }), nil
+	}
+	return a, nil
+}
+
+// FlipHorizontal returns a copy of a mirrored left to right, remapping the
+// frames as Rotate does.
+func FlipHorizontal(a APNG) APNG {
+	return orient(a, false, func(x, y, w, h int) (int, int) { return w - 1 - x, y })
+}
+
+// FlipVertical returns a copy of a mirrored top to bottom, remapping the
+// frames as Rotate does.
+func FlipVertical(a APNG) APNG {
+	return orient(a, false, func(x, y, w, h int) (int, int) { return x, h - 1 - y })
+}
+
+// orient returns a copy of a with the canvas and each frame remapped by
+// move, which returns where the pixel at (x, y) of a w by h image goes.
+// swap reports whether move swaps the width and height. A frame's
+// rectangle on the canvas is remapped by moving its corners.
+func orient(a APNG, swap bool, move func(x, y, w, h int) (int, int)) APNG {
+	if len(a.Frames) == 0 {
+		return a
+	}
+	b := a.Frames[0].Image.Bounds()
+	out := APNG{LoopCount: a.LoopCount, Keyframes: append([]int(nil), a.Keyframes...)}
+	out.Frames = make([]Frame, len(a.Frames))
+	for i, f := range a.Frames {
+		fb := f.Image.Bounds()
+		x0, y0 := move(f.XOffset, f.YOffset, b.Dx(), b.Dy())
+		x1, y1 := move(f.XOffset+fb.Dx()-1, f.YOffset+fb.Dy()-1, b.Dx(), b.Dy())
+		if x1 < x0 {
+			x0 = x1
+		}
+		if y1 < y0 {
+			y0 = y1
+		}
+		f.Image = orientImage(f.Image, swap, move)
+		f.XOffset, f.YOffset = x0, y0
+		out.Frames[i] = f
+	}
+	return out
+}
+
+// orientImage returns a copy of m remapped by move, as for orient, with its
+// origin at (0, 0).
+func orientImage(m image.Image, swap bool, move func(x, y, w, h int) (int, int)) image.Image {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	r := image.Rect(0, 0, w, h)
+	if swap {
+		r = image.Rect(0, 0, h, w)
+	}
+	src, ok := pixBuffer(m)
+	if !ok {
+		m = toNRGBA64(m)
+		b = m.Bounds()
+		src, _ = pixBuffer(m)
+	}
+	n := newImageLike(m, r)
+	dst, _ := pixBuffer(n)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := move(x, y, w, h)
+			i := src.offset(b.Min.X+x, b.Min.Y+y)
+			copy(dst.pix[dst.offset(dx, dy):], src.pix[i:i+src.bpp])
+		}
+	}
+	return n
+}
+
+// pixels is the pixel data of one of the image package's types that keep
+// their pixels in a Pix slice, with a fixed number of bytes per pixel.
+type pixels struct {
+	pix    []uint8
+	stride int
+	rect   image.Rectangle
+	bpp    int
+}
+
+// offset returns the index in p.pix of the pixel at (x, y).
+func (p pixels) offset(x, y int) int {
+	return (y-p.rect.Min.Y)*p.stride + (x-p.rect.Min.X)*p.bpp
+}
+
+// pixBuffer returns the pixel data of m, and reports false if m is not of
+// one of the types it knows.
+func pixBuffer(m image.Image) (pixels, bool) {
+	switch m := m.(type) {
+	case *image.Paletted:
+		return pixels{m.Pix, m.Stride, m.Rect, 1}, true
+	case *image.Gray:
+		return pixels{m.Pix, m.Stride, m.Rect, 1}, true
+	case *image.Alpha:
+		return pixels{m.Pix, m.Stride, m.Rect, 1}, true
+	case *image.Gray16:
+		return pixels{m.Pix, m.Stride, m.Rect, 2}, true
+	case *image.Alpha16:
+		return pixels{m.Pix, m.Stride, m.Rect, 2}, true
+	case *image.NRGBA:
+		return pixels{m.Pix, m.Stride, m.Rect, 4}, true
+	case *image.RGBA:
+		return pixels{m.Pix, m.Stride, m.Rect, 4}, true
+	case *image.CMYK:
+		return pixels{m.Pix, m.Stride, m.Rect, 4}, true
+	case *image.NRGBA64:
+		return pixels{m.Pix, m.Stride, m.Rect, 8}, true
+	case *image.RGBA64:
+		return pixels{m.Pix, m.Stride, m.Rect, 8}, true
+	}
+	return pixels{}, false
+}
+
+// newImageLike returns a new image of the same type as m, which must be
+// one of the types pixBuffer knows, with bounds r. A paletted image keeps
+// m's palette.
+func newImageLike(m image.Image, r image.Rectangle) image.Image {
+	switch m := m.(type) {
+	case *image.Paletted:
+		return image.NewPaletted(r, m.Palette)
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Alpha:
+		return image.NewAlpha(r)
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.Alpha16:
+		return image.NewAlpha16(r)
+	case *image.NRGBA:
+		return image.NewNRGBA(r)
+	case *image.RGBA:
+		return image.NewRGBA(r)
+	case *image.CMYK:
+		return image.NewCMYK(r)
+	case *image.RGBA64:
+		return image.NewRGBA64(r)
+	}
+	return image.NewNRGBA64(r)
+}
+
+// subImage returns the part r of m, sharing its pixels if m has a SubImage
+// method, and otherwise as a copy.
+func subImage(m image.Image, r image.Rectangle) image.Image {
+	if s, ok := m.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	n := image.NewNRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	var buf [8]uint8
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			copy(n.Pix[n.PixOffset(x, y):], pixelNRGBA64(m, r.Min.X+x, r.Min.Y+y, buf[:]))
+		}
+	}
+	return n
+}
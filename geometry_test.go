@@ -0,0 +1,274 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+)
+
+// checkMoved checks that every canvas of b is the canvas of a with each
+// pixel moved by move, and that b's frames are no larger than a's.
+func checkMoved(t *testing.T, name string, a, b APNG, move func(x, y, w, h int) (int, int)) {
+	t.Helper()
+	want, got := composite(a), composite(b)
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d frames, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		r := want[i].Rect
+		for y := 0; y < r.Dy(); y++ {
+			for x := 0; x < r.Dx(); x++ {
+				dx, dy := move(x, y, r.Dx(), r.Dy())
+				if c0, c1 := want[i].NRGBA64At(x, y), got[i].NRGBA64At(dx, dy); c0 != c1 {
+					t.Fatalf("%s: frame %d: (%d, %d) is %v, want %v from (%d, %d)", name, i, dx, dy, c1, c0, x, y)
+				}
+			}
+		}
+		s0, s1 := a.Frames[i].Image.Bounds().Size(), b.Frames[i].Image.Bounds().Size()
+		if s0.X*s0.Y != s1.X*s1.Y {
+			t.Errorf("%s: frame %d: size %v, want %v", name, i, s1, s0)
+		}
+	}
+}
+
+func TestRotateFlip(t *testing.T) {
+	a := deltaSquare(t, 6)
+	for _, test := range []struct {
+		degrees int
+		move    func(x, y, w, h int) (int, int)
+	}{
+		{90, func(x, y, w, h int) (int, int) { return h - 1 - y, x }},
+		{180, func(x, y, w, h int) (int, int) { return w - 1 - x, h - 1 - y }},
+		{270, func(x, y, w, h int) (int, int) { return y, w - 1 - x }},
+		{-90, func(x, y, w, h int) (int, int) { return y, w - 1 - x }},
+		{360, func(x, y, w, h int) (int, int) { return x, y }},
+	} {
+		b, err := Rotate(a, test.degrees)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMoved(t, "Rotate", a, b, test.move)
+	}
+	checkMoved(t, "FlipHorizontal", a, FlipHorizontal(a), func(x, y, w, h int) (int, int) { return w - 1 - x, y })
+	checkMoved(t, "FlipVertical", a, FlipVertical(a), func(x, y, w, h int) (int, int) { return x, h - 1 - y })
+
+	if _, err := Rotate(a, 45); err == nil {
+		t.Error("no error for a rotation by 45 degrees")
+	}
+
+	// Paletted images stay paletted.
+	pal := color.Palette{color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{0xff, 0, 0, 0xff}}
+	p := movingSquare(2, func(r image.Rectangle) image.Image { return image.NewPaletted(r, pal) })
+	b, err := Rotate(p, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Frames[1].Image.(*image.Paletted); !ok {
+		t.Errorf("got %T, want *image.Paletted", b.Frames[1].Image)
+	}
+}
+
+func TestCrop(t *testing.T) {
+	a := deltaSquare(t, 6)
+	r := image.Rect(20, 5, 50, 30)
+	b, err := Crop(a, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Frames[0].Image.Bounds().Size(); s != r.Size() {
+		t.Fatalf("canvas is %v, want %v", s, r.Size())
+	}
+	// Frames outside r are dropped, so frames are compared by when they
+	// are shown.
+	want, got := newTimeline(a), newTimeline(b)
+	if got.total() != want.total() {
+		t.Errorf("got a total duration of %v, want %v", got.total(), want.total())
+	}
+	for i, m := range want.canvases {
+		j := got.at(want.starts[i])
+		if err := diff(m.SubImage(r), got.canvases[j]); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+
+	// The clipped frames share a's pixels, and must encode as they are.
+	var buf bytes.Buffer
+	if err := Encode(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+	c, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range composite(c) {
+		if err := diff(got.canvases[i], m); err != nil {
+			t.Errorf("encoded frame %d: %v", i, err)
+		}
+	}
+
+	// Below the moving square, nothing changes after the first frame, so
+	// the other frames are dropped and their delays added to it.
+	b, err = Crop(a, image.Rect(0, 20, 64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(b.Frames))
+	}
+	if d := b.Frames[0].Duration(); d != 210*time.Millisecond {
+		t.Errorf("got a delay of %v, want 210ms", d)
+	}
+
+	if _, err := Crop(a, image.Rect(-1, 0, 10, 10)); err == nil {
+		t.Error("no error for a rectangle outside the canvas")
+	}
+}
+
+func TestCropDroppedAfterDispose(t *testing.T) {
+	solid := func(w, h int, c color.NRGBA) *image.NRGBA {
+		m := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for i := 0; i < len(m.Pix); i += 4 {
+			m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		return m
+	}
+	red, blue, green := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}, color.NRGBA{0, 0xff, 0, 0xff}
+	// The blue frame is cleared after 10ms, while the green frame, which is
+	// outside the crop, is shown for 5s.
+	a := APNG{Frames: []Frame{
+		{Image: solid(4, 4, red), DelayNumerator: 10, DelayDenominator: 1000},
+		{Image: solid(2, 2, blue), DisposeOp: DISPOSE_OP_BACKGROUND, DelayNumerator: 10, DelayDenominator: 1000},
+		{Image: solid(2, 2, green), XOffset: 2, YOffset: 2, DelayNumerator: 5, DelayDenominator: 1},
+	}}
+	b, err := Crop(a, image.Rect(0, 0, 2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(b.Frames))
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+	c, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []APNG{b, c} {
+		tl := newTimeline(b)
+		if tl.total() != 5020*time.Millisecond {
+			t.Errorf("got a total duration of %v, want 5.02s", tl.total())
+		}
+		for _, test := range []struct {
+			at   time.Duration
+			want color.NRGBA
+		}{
+			{0, red},
+			{15 * time.Millisecond, blue},
+			{time.Second, color.NRGBA{}},
+		} {
+			if err := diff(solid(2, 2, test.want), tl.canvases[tl.at(test.at)]); err != nil {
+				t.Errorf("at %v: %v", test.at, err)
+			}
+		}
+	}
+}
+
+func TestCropPlaceholderTypes(t *testing.T) {
+	light, mid, dark := color.Gray{0xc0}, color.Gray{0x80}, color.Gray{0x40}
+	newImages := map[string]func(image.Rectangle) draw.Image{
+		"nrgba": func(r image.Rectangle) draw.Image { return image.NewNRGBA(r) },
+		"gray":  func(r image.Rectangle) draw.Image { return image.NewGray(r) },
+		// The palette has no transparent color.
+		"paletted": func(r image.Rectangle) draw.Image {
+			return image.NewPaletted(r, color.Palette{light, mid, dark})
+		},
+	}
+	for name, newImage := range newImages {
+		solid := func(w, h int, c color.Color) image.Image {
+			m := newImage(image.Rect(0, 0, w, h))
+			draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+			return m
+		}
+		// The mid frame is cleared after 10ms, while the dark frame, which
+		// is outside the crops, is shown for 5s.
+		a := APNG{Frames: []Frame{
+			{Image: solid(4, 4, light), DelayNumerator: 10, DelayDenominator: 1000},
+			{Image: solid(2, 2, mid), DisposeOp: DISPOSE_OP_BACKGROUND, DelayNumerator: 10, DelayDenominator: 1000},
+			{Image: solid(1, 1, dark), XOffset: 3, YOffset: 3, DelayNumerator: 5, DelayDenominator: 1},
+		}}
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 3, 3), image.Rect(0, 0, 2, 2)} {
+			b, err := Crop(a, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := Encode(&buf, b); err != nil {
+				t.Fatalf("%s %v: %v", name, r, err)
+			}
+			c, err := DecodeAll(&buf)
+			if err != nil {
+				t.Fatalf("%s %v: %v", name, r, err)
+			}
+			want := newTimeline(a)
+			times := []time.Duration{0, 15 * time.Millisecond, time.Second}
+			if name == "gray" && r.Dx() == 2 {
+				// Gray can't show the cleared canvas, so the mid frame is
+				// shown for longer instead.
+				times = times[:2]
+				if len(b.Frames) != 2 {
+					t.Errorf("%s %v: got %d frames, want 2", name, r, len(b.Frames))
+				}
+			}
+			for _, b := range []APNG{b, c} {
+				got := newTimeline(b)
+				if got.total() != want.total() {
+					t.Errorf("%s %v: got a total duration of %v, want %v", name, r, got.total(), want.total())
+				}
+				for _, at := range times {
+					if err := diff(want.canvases[want.at(at)].SubImage(r), got.canvases[got.at(at)]); err != nil {
+						t.Errorf("%s %v: at %v: %v", name, r, at, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	a := movingSquare(6, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	var buf bytes.Buffer
+	if err := (&Encoder{KeyframeInterval: KeyframeInterval{Frames: 3}}).Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	a, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Pad(a, 3, 4, 5, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canvas := image.Rect(0, 0, 72, 58)
+	for _, k := range append([]int{0}, b.Keyframes...) {
+		if f := b.Frames[k]; f.Image.Bounds() != canvas || f.XOffset != 0 || f.YOffset != 0 {
+			t.Errorf("frame %d covers %v at (%d, %d), want the whole canvas", k, f.Image.Bounds(), f.XOffset, f.YOffset)
+		}
+	}
+	want, got := composite(a), composite(b)
+	for i := range want {
+		m := image.NewNRGBA64(canvas)
+		copyRect(m, image.Rect(3, 4, 67, 52), want[i], image.Point{})
+		if err := diff(m, got[i]); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+}
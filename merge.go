@@ -0,0 +1,113 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"context"
+	"image"
+	"math/big"
+)
+
+// mergeFrames returns a copy of a in which each run of consecutive frames
+// that composite to the same canvas, within enc.MergeTolerance, is replaced
+// by one full-canvas frame showing the run's first canvas for the sum of
+// the run's delays. A run is cut short if its delay can no longer be given
+// exactly by a frame's delay fraction, so that merging never changes when
+// frames are shown. If nothing is merged, a is returned unchanged.
+// ctx is checked before each frame.
+func (enc *Encoder) mergeFrames(ctx context.Context, a APNG) (APNG, error) {
+	if len(a.Frames) == 0 {
+		return a, nil
+	}
+	frames := a.Frames
+	out := APNG{LoopCount: a.LoopCount}
+	if frames[0].IsDefault {
+		def := frames[0]
+		def.Image = toNRGBA64(def.Image)
+		out.Frames = append(out.Frames, def)
+		frames = frames[1:]
+	}
+	if len(frames) == 0 {
+		return a, nil
+	}
+	b := a.Frames[0].Image.Bounds()
+	c := newCompositor(b.Dx(), b.Dy())
+	tolerance := uint16(enc.MergeTolerance) * 0x101
+
+	var (
+		kept   *image.NRGBA64
+		first  Frame // The first frame of the run.
+		delay  *big.Rat
+		run    int
+		merged bool
+	)
+	keep := func() {
+		f := Frame{Image: kept, DelayNumerator: first.DelayNumerator, DelayDenominator: first.DelayDenominator}
+		if run > 1 {
+			f.DelayNumerator, f.DelayDenominator, _ = exactDelayFraction(delay)
+		}
+		out.Frames = append(out.Frames, f)
+	}
+	for _, f := range frames {
+		if err := ctx.Err(); err != nil {
+			return a, err
+		}
+		c.draw(f)
+		if kept != nil && similarImages(kept, c.canvas, tolerance) {
+			sum := new(big.Rat).Add(delay, f.delayRat())
+			if _, _, ok := exactDelayFraction(sum); ok {
+				delay = sum
+				run++
+				merged = true
+				continue
+			}
+		}
+		if kept != nil {
+			keep()
+		}
+		kept = image.NewNRGBA64(c.canvas.Rect)
+		copy(kept.Pix, c.canvas.Pix)
+		first, delay, run = f, f.delayRat(), 1
+	}
+	keep()
+
+	if !merged {
+		return a, nil
+	}
+	if !enc.deltaEncoding() {
+		convertDeltaFrames(out.Frames, frames[0].Image)
+	}
+	return out, nil
+}
+
+// similarImages reports whether every pixel of the NRGBA64 images m0 and m1,
+// which must have the same bounds, is similar as per similarPixel.
+func similarImages(m0, m1 *image.NRGBA64, tolerance uint16) bool {
+	for i := 0; i < len(m0.Pix); i += 8 {
+		if !similarPixel(m0.Pix[i:i+8], m1.Pix[i:i+8], tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// similarPixel reports whether the NRGBA64 pixels p and q differ by at most
+// tolerance in each channel. Fully transparent pixels are always similar.
+func similarPixel(p, q []uint8, tolerance uint16) bool {
+	if samePixel(p, q) {
+		return true
+	}
+	if tolerance == 0 {
+		return false
+	}
+	for j := 0; j < 8; j += 2 {
+		v0 := int(p[j])<<8 | int(p[j+1])
+		v1 := int(q[j])<<8 | int(q[j+1])
+		if v0-v1 > int(tolerance) || v1-v0 > int(tolerance) {
+			return false
+		}
+	}
+	return true
+}
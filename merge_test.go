@@ -0,0 +1,122 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math/big"
+	"testing"
+)
+
+func TestMergeFrames(t *testing.T) {
+	solid := func(c color.NRGBA) *image.NRGBA {
+		m := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		for i := 0; i < len(m.Pix); i += 4 {
+			m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		return m
+	}
+	red, green := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0xff, 0, 0xff}
+	nearRed := color.NRGBA{0xfc, 0x02, 0, 0xff}
+	a := APNG{Frames: []Frame{
+		{Image: solid(red), DelayNumerator: 1, DelayDenominator: 10},
+		{Image: solid(red), DelayNumerator: 1, DelayDenominator: 30},
+		// A transparent frame drawn over the last one changes nothing.
+		{Image: image.NewNRGBA(image.Rect(0, 0, 2, 2)), XOffset: 3, BlendOp: BLEND_OP_OVER, DelayNumerator: 5},
+		{Image: solid(nearRed), DelayNumerator: 1, DelayDenominator: 3},
+		{Image: solid(green), DelayNumerator: 7},
+	}}
+
+	tests := []struct {
+		tolerance uint8
+		colors    []color.NRGBA
+		delays    [][2]uint16
+	}{
+		{0, []color.NRGBA{red, nearRed, green}, [][2]uint16{{11, 60}, {1, 3}, {7, 0}}},
+		{4, []color.NRGBA{red, green}, [][2]uint16{{31, 60}, {7, 0}}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := &Encoder{MergeFrames: true, MergeTolerance: test.tolerance}
+		if err := enc.Encode(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+		b, err := DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b.Frames) != len(test.colors) {
+			t.Fatalf("tolerance %d: got %d frames, want %d", test.tolerance, len(b.Frames), len(test.colors))
+		}
+		for i, f := range b.Frames {
+			if err := diff(f.Image, solid(test.colors[i])); err != nil {
+				t.Errorf("tolerance %d: frame %d: %v", test.tolerance, i, err)
+			}
+			if f.DelayNumerator != test.delays[i][0] || f.DelayDenominator != test.delays[i][1] {
+				t.Errorf("tolerance %d: frame %d: delay %d/%d, want %d/%d", test.tolerance, i,
+					f.DelayNumerator, f.DelayDenominator, test.delays[i][0], test.delays[i][1])
+			}
+		}
+	}
+}
+
+func TestMergeFramesDelayLimit(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 4, 4))
+	a := APNG{}
+	for i := 0; i < 3; i++ {
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNumerator: 40000, DelayDenominator: 1})
+	}
+	b, err := (&Encoder{MergeFrames: true}).mergeFrames(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Frames) != 3 {
+		t.Errorf("got %d frames, want 3 as no two delays fit in one frame", len(b.Frames))
+	}
+
+	// Sums that only fit when rounded end the run, so that the total
+	// duration stays exact.
+	a = APNG{}
+	for _, den := range []uint16{7, 11, 13, 65521, 65519} {
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNumerator: 1, DelayDenominator: den})
+	}
+	b, err = (&Encoder{MergeFrames: true}).mergeFrames(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]uint16
+	for _, f := range b.Frames {
+		got = append(got, [2]uint16{f.DelayNumerator, f.DelayDenominator})
+	}
+	if want := [][2]uint16{{311, 1001}, {1, 65521}, {1, 65519}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got delays %v, want %v", got, want)
+	}
+}
+
+func TestDelayFraction(t *testing.T) {
+	tests := []struct {
+		r        *big.Rat
+		num, den uint16
+		ok       bool
+	}{
+		{big.NewRat(3, 7), 3, 7, true},
+		{big.NewRat(65535, 1), 65535, 1, true},
+		{big.NewRat(65536, 1), 0, 0, false},
+		{big.NewRat(1, 100000), 1, 65535, true},
+		{big.NewRat(1, 1000000), 0, 1, true},
+		// The closest fraction to 3.14159265 that fits.
+		{big.NewRat(314159265, 100000000), 65298, 20785, true},
+	}
+	for _, test := range tests {
+		num, den, ok := delayFraction(test.r)
+		if num != test.num || den != test.den || ok != test.ok {
+			t.Errorf("delayFraction(%v) = %d/%d, %v, want %d/%d, %v", test.r, num, den, ok, test.num, test.den, test.ok)
+		}
+	}
+}
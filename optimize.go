@@ -0,0 +1,246 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// optimizeTrial is one combination of encoder settings tried for each frame.
+type optimizeTrial struct {
+	filter   FilterStrategy
+	level    CompressionLevel
+	strategy CompressionStrategy
+}
+
+// optimizeTrials lists the settings tried by Optimize. Numeric levels below 4
+// rarely win and are skipped.
+var optimizeTrials = func() []optimizeTrial {
+	filters := []FilterStrategy{
+		NoneFilter, SubFilter, UpFilter, AverageFilter, PaethFilter,
+		AdaptiveFilter, EntropyFilter, BruteForceFilter,
+	}
+	var trials []optimizeTrial
+	for _, f := range filters {
+		for _, l := range []CompressionLevel{4, 6, 9} {
+			trials = append(trials, optimizeTrial{f, l, DefaultStrategy})
+		}
+		// The strategies that keep the smaller of a level and Huffman
+		// coding only are covered by trying both.
+		trials = append(trials, optimizeTrial{f, 9, HuffmanOnlyStrategy})
+	}
+	return trials
+}()
+
+// Optimize reads an APNG from r and writes the smallest encoding of it that
+// it can find to w. It tries every lossless color reduction that applies,
+// then, separately for each frame, every filter strategy, several
+// compression levels and Huffman coding only. Each frame's image data
+// is written as a single chunk, which has the least overhead.
+//
+// The result is decoded again and compared with the input, and only kept if
+// every frame has identical pixels. If no encoding is smaller than the input,
+// the input is copied to w unchanged. Optimize is very slow compared with
+// Encode, and is meant for assets that are encoded once and served many
+// times.
+func Optimize(r io.Reader, w io.Writer) error {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	a, err := DecodeAll(bytes.NewReader(in))
+	if err != nil {
+		return err
+	}
+	best := in
+	for _, c := range colorReductions(a) {
+		out, err := optimizeFrames(c)
+		if err != nil {
+			return err
+		}
+		if len(out) >= len(best) {
+			continue
+		}
+		if ok, err := sameAnimation(a, out); err != nil {
+			return err
+		} else if ok {
+			best = out
+		}
+	}
+	_, err = w.Write(best)
+	return err
+}
+
+// optimizeFrames encodes a, using for each frame the trial settings that
+// compress its image data the smallest.
+func optimizeFrames(a APNG) ([]byte, error) {
+	enc := &Encoder{ChunkSize: maxChunkData}
+	e := &encoder{enc: enc, a: a}
+	e.setColorType()
+	compressed := make([][]byte, len(a.Frames))
+	var b bytes.Buffer
+	for i, f := range a.Frames {
+		for _, t := range optimizeTrials {
+			e.enc = &Encoder{
+				CompressionLevel:    t.level,
+				CompressionStrategy: t.strategy,
+				FilterStrategy:      t.filter,
+			}
+			b.Reset()
+			if err := e.writeImage(&b, f.Image, e.cb, t.level); err != nil {
+				return nil, err
+			}
+			// writeImage closes the compression writer, so b holds a
+			// complete zlib stream.
+			if compressed[i] == nil || b.Len() < len(compressed[i]) {
+				compressed[i] = append(compressed[i][:0], b.Bytes()...)
+			}
+		}
+	}
+	b.Reset()
+	if err := enc.encode(context.Background(), &b, a, compressed); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// sameAnimation reports whether data decodes to the same frames as a, with
+// identical pixels, frame control fields and keyframes.
+func sameAnimation(a APNG, data []byte) (bool, error) {
+	b, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if len(a.Frames) != len(b.Frames) || a.LoopCount != b.LoopCount || len(a.Keyframes) != len(b.Keyframes) {
+		return false, nil
+	}
+	for i, k := range a.Keyframes {
+		if b.Keyframes[i] != k {
+			return false, nil
+		}
+	}
+	for i := range a.Frames {
+		fa, fb := a.Frames[i], b.Frames[i]
+		if fa.IsDefault != fb.IsDefault || fa.XOffset != fb.XOffset || fa.YOffset != fb.YOffset ||
+			fa.DelayNumerator != fb.DelayNumerator || fa.DelayDenominator != fb.DelayDenominator ||
+			fa.DisposeOp != fb.DisposeOp || fa.BlendOp != fb.BlendOp {
+			return false, nil
+		}
+		if !samePixels(fa.Image, fb.Image) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// samePixels reports whether m0 and m1 are the same size and have the same
+// alpha-premultiplied color at every pixel.
+func samePixels(m0, m1 image.Image) bool {
+	b0, b1 := m0.Bounds(), m1.Bounds()
+	if !b0.Size().Eq(b1.Size()) {
+		return false
+	}
+	dx, dy := b1.Min.X-b0.Min.X, b1.Min.Y-b0.Min.Y
+	for y := b0.Min.Y; y < b0.Max.Y; y++ {
+		for x := b0.Min.X; x < b0.Max.X; x++ {
+			r0, g0, b0, a0 := m0.At(x, y).RGBA()
+			r1, g1, b1, a1 := m1.At(x+dx, y+dy).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// colorReductions returns a along with every lossless conversion of its
+// frames to a smaller color type: 8-bit NRGBA for deeper images whose
+// colors all fit in 8 bits per channel, grayscale for opaque gray images,
+// and paletted for images with at most 256 distinct colors.
+func colorReductions(a APNG) []APNG {
+	var (
+		fits8  = true // Every color survives a round trip through NRGBA.
+		gray   = true // Every color is an opaque shade of gray.
+		deep   = false
+		colors = map[color.RGBA64]bool{}
+	)
+	var pal color.Palette
+	for _, f := range a.Frames {
+		switch f.Image.(type) {
+		case *image.Gray, *image.NRGBA, *image.RGBA, *image.Paletted:
+		default:
+			deep = true
+		}
+		b := f.Image.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := f.Image.At(x, y)
+				r, g, b, a := c.RGBA()
+				key := color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+				if colors[key] {
+					continue
+				}
+				n := color.NRGBAModel.Convert(c).(color.NRGBA)
+				if r1, g1, b1, a1 := n.RGBA(); r1 != r || g1 != g || b1 != b || a1 != a {
+					fits8 = false
+				}
+				if a != 0xffff || r != g || g != b {
+					gray = false
+				}
+				if len(colors) <= 256 {
+					colors[key] = true
+					pal = append(pal, n)
+				}
+			}
+		}
+	}
+
+	reductions := []APNG{a}
+	if !fits8 {
+		return reductions
+	}
+	convert := func(newImage func(r image.Rectangle) draw.Image) APNG {
+		c := APNG{Frames: make([]Frame, len(a.Frames)), LoopCount: a.LoopCount, Keyframes: a.Keyframes}
+		for i, f := range a.Frames {
+			b := f.Image.Bounds()
+			m := newImage(image.Rect(0, 0, b.Dx(), b.Dy()))
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					m.Set(x-b.Min.X, y-b.Min.Y, f.Image.At(x, y))
+				}
+			}
+			c.Frames[i] = f
+			c.Frames[i].Image = m
+		}
+		return c
+	}
+	if deep {
+		reductions = append(reductions, convert(func(r image.Rectangle) draw.Image { return image.NewNRGBA(r) }))
+	}
+	if gray {
+		reductions = append(reductions, convert(func(r image.Rectangle) draw.Image { return image.NewGray(r) }))
+	}
+	if len(colors) <= 256 {
+		// Put the translucent colors first, so that the tRNS chunk is short.
+		sorted := make(color.Palette, 0, len(pal))
+		for _, c := range pal {
+			if c.(color.NRGBA).A != 0xff {
+				sorted = append(sorted, c)
+			}
+		}
+		for _, c := range pal {
+			if c.(color.NRGBA).A == 0xff {
+				sorted = append(sorted, c)
+			}
+		}
+		reductions = append(reductions, convert(func(r image.Rectangle) draw.Image { return image.NewPaletted(r, sorted) }))
+	}
+	return reductions
+}
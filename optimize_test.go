@@ -0,0 +1,100 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	colors := []color.NRGBA64{
+		{0x0000, 0x0000, 0x0000, 0xffff},
+		{0xffff, 0x0000, 0x0000, 0xffff},
+		{0x0000, 0xffff, 0x0000, 0x8080},
+		{0x0000, 0x0000, 0x0000, 0x0000},
+	}
+	gray := []color.NRGBA64{
+		{0x1010, 0x1010, 0x1010, 0xffff},
+		{0xa0a0, 0xa0a0, 0xa0a0, 0xffff},
+	}
+	testCases := []struct {
+		name   string
+		colors []color.NRGBA64
+	}{
+		{"paletted", colors},
+		{"gray", gray},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// 16-bit frames with few colors, which Encode writes as is. The
+			// keyframe index must survive the color reduction.
+			a := APNG{Frames: make([]Frame, 3), LoopCount: 2, Keyframes: []int{0, 2}}
+			for i := range a.Frames {
+				m := image.NewNRGBA64(image.Rect(0, 0, 24, 16))
+				for y := 0; y < 16; y++ {
+					for x := 0; x < 24; x++ {
+						m.SetNRGBA64(x, y, tc.colors[(x/4+y/3+i)%len(tc.colors)])
+					}
+				}
+				a.Frames[i].Image = m
+				a.Frames[i].DelayNumerator = uint16(i + 1)
+				a.Frames[i].DelayDenominator = 10
+			}
+
+			var in bytes.Buffer
+			if err := Encode(&in, a); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := Optimize(bytes.NewReader(in.Bytes()), &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Len() >= in.Len() {
+				t.Errorf("optimized size %d is not smaller than %d", out.Len(), in.Len())
+			}
+			if ok, err := sameAnimation(a, out.Bytes()); err != nil {
+				t.Fatal(err)
+			} else if !ok {
+				t.Error("optimized animation differs from the input")
+			}
+			if b, err := DecodeAll(bytes.NewReader(out.Bytes())); err != nil {
+				t.Fatal(err)
+			} else if len(b.Keyframes) != 2 || b.Keyframes[0] != 0 || b.Keyframes[1] != 2 {
+				t.Errorf("got keyframes %v, want [0 2]", b.Keyframes)
+			}
+
+			// Optimizing again can't make the file any larger.
+			var again bytes.Buffer
+			if err := Optimize(bytes.NewReader(out.Bytes()), &again); err != nil {
+				t.Fatal(err)
+			}
+			if again.Len() > out.Len() {
+				t.Errorf("reoptimized size %d is larger than %d", again.Len(), out.Len())
+			}
+		})
+	}
+}
+
+func TestColorReductions(t *testing.T) {
+	m := image.NewRGBA64(image.Rect(0, 0, 300, 1))
+	for x := 0; x < 300; x++ {
+		// 300 distinct colors that need 16 bits per channel.
+		m.SetRGBA64(x, 0, color.RGBA64{uint16(x), 0, 0, 0xffff})
+	}
+	if got := len(colorReductions(APNG{Frames: []Frame{{Image: m}}})); got != 1 {
+		t.Errorf("got %d reductions of a 16-bit image, want 1", got)
+	}
+
+	// The same number of colors in 8 bits can be reduced to NRGBA only.
+	for x := 0; x < 300; x++ {
+		m.SetRGBA64(x, 0, color.RGBA64{uint16(x%256) * 0x101, uint16(x/256) * 0x101, 0, 0xffff})
+	}
+	if got := len(colorReductions(APNG{Frames: []Frame{{Image: m}}})); got != 2 {
+		t.Errorf("got %d reductions of an 8-bit image, want 2", got)
+	}
+}
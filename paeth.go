@@ -69,3 +69,112 @@ func filterPaeth(cdat, pdat []byte, bytesPerPixel int) {
 		}
 	}
 }
+
+// paethPredictor is paeth for int arguments, as used by the filterPaeth
+// variants below, which keep each channel's values in ints.
+func paethPredictor(a, b, c int) int {
+	pa := b - c
+	pb := a - c
+	pc := abs(pa + pb)
+	pa = abs(pa)
+	pb = abs(pb)
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// filterPaeth1 is filterPaeth for one byte per pixel.
+func filterPaeth1(cdat, pdat []byte) {
+	var a, c int
+	for i := range cdat {
+		b := int(pdat[i])
+		a = (paethPredictor(a, b, c) + int(cdat[i])) & 0xff
+		cdat[i] = uint8(a)
+		c = b
+	}
+}
+
+// filterPaeth2 is filterPaeth for two bytes per pixel, handling a whole
+// pixel at a time.
+func filterPaeth2(cdat, pdat []byte) {
+	var a0, a1, c0, c1 int
+	for i := 0; i+2 <= len(cdat); i += 2 {
+		b0, b1 := int(pdat[i+0]), int(pdat[i+1])
+		a0 = (paethPredictor(a0, b0, c0) + int(cdat[i+0])) & 0xff
+		a1 = (paethPredictor(a1, b1, c1) + int(cdat[i+1])) & 0xff
+		cdat[i+0], cdat[i+1] = uint8(a0), uint8(a1)
+		c0, c1 = b0, b1
+	}
+}
+
+// filterPaeth3 is filterPaeth for three bytes per pixel, handling a whole
+// pixel at a time.
+func filterPaeth3(cdat, pdat []byte) {
+	var a0, a1, a2, c0, c1, c2 int
+	for i := 0; i+3 <= len(cdat); i += 3 {
+		b0, b1, b2 := int(pdat[i+0]), int(pdat[i+1]), int(pdat[i+2])
+		a0 = (paethPredictor(a0, b0, c0) + int(cdat[i+0])) & 0xff
+		a1 = (paethPredictor(a1, b1, c1) + int(cdat[i+1])) & 0xff
+		a2 = (paethPredictor(a2, b2, c2) + int(cdat[i+2])) & 0xff
+		cdat[i+0], cdat[i+1], cdat[i+2] = uint8(a0), uint8(a1), uint8(a2)
+		c0, c1, c2 = b0, b1, b2
+	}
+}
+
+// filterPaeth4 is filterPaeth for four bytes per pixel, handling a whole
+// pixel at a time.
+func filterPaeth4(cdat, pdat []byte) {
+	var a0, a1, a2, a3, c0, c1, c2, c3 int
+	for i := 0; i+4 <= len(cdat); i += 4 {
+		b0, b1, b2, b3 := int(pdat[i+0]), int(pdat[i+1]), int(pdat[i+2]), int(pdat[i+3])
+		a0 = (paethPredictor(a0, b0, c0) + int(cdat[i+0])) & 0xff
+		a1 = (paethPredictor(a1, b1, c1) + int(cdat[i+1])) & 0xff
+		a2 = (paethPredictor(a2, b2, c2) + int(cdat[i+2])) & 0xff
+		a3 = (paethPredictor(a3, b3, c3) + int(cdat[i+3])) & 0xff
+		cdat[i+0], cdat[i+1], cdat[i+2], cdat[i+3] = uint8(a0), uint8(a1), uint8(a2), uint8(a3)
+		c0, c1, c2, c3 = b0, b1, b2, b3
+	}
+}
+
+// filterPaeth6 is filterPaeth for six bytes per pixel, handling a whole
+// pixel at a time.
+func filterPaeth6(cdat, pdat []byte) {
+	var a0, a1, a2, a3, a4, a5, c0, c1, c2, c3, c4, c5 int
+	for i := 0; i+6 <= len(cdat); i += 6 {
+		b0, b1, b2 := int(pdat[i+0]), int(pdat[i+1]), int(pdat[i+2])
+		b3, b4, b5 := int(pdat[i+3]), int(pdat[i+4]), int(pdat[i+5])
+		a0 = (paethPredictor(a0, b0, c0) + int(cdat[i+0])) & 0xff
+		a1 = (paethPredictor(a1, b1, c1) + int(cdat[i+1])) & 0xff
+		a2 = (paethPredictor(a2, b2, c2) + int(cdat[i+2])) & 0xff
+		a3 = (paethPredictor(a3, b3, c3) + int(cdat[i+3])) & 0xff
+		a4 = (paethPredictor(a4, b4, c4) + int(cdat[i+4])) & 0xff
+		a5 = (paethPredictor(a5, b5, c5) + int(cdat[i+5])) & 0xff
+		cdat[i+0], cdat[i+1], cdat[i+2] = uint8(a0), uint8(a1), uint8(a2)
+		cdat[i+3], cdat[i+4], cdat[i+5] = uint8(a3), uint8(a4), uint8(a5)
+		c0, c1, c2, c3, c4, c5 = b0, b1, b2, b3, b4, b5
+	}
+}
+
+// filterPaeth8 is filterPaeth for eight bytes per pixel, handling a whole
+// pixel at a time.
+func filterPaeth8(cdat, pdat []byte) {
+	var a0, a1, a2, a3, a4, a5, a6, a7, c0, c1, c2, c3, c4, c5, c6, c7 int
+	for i := 0; i+8 <= len(cdat); i += 8 {
+		b0, b1, b2, b3 := int(pdat[i+0]), int(pdat[i+1]), int(pdat[i+2]), int(pdat[i+3])
+		b4, b5, b6, b7 := int(pdat[i+4]), int(pdat[i+5]), int(pdat[i+6]), int(pdat[i+7])
+		a0 = (paethPredictor(a0, b0, c0) + int(cdat[i+0])) & 0xff
+		a1 = (paethPredictor(a1, b1, c1) + int(cdat[i+1])) & 0xff
+		a2 = (paethPredictor(a2, b2, c2) + int(cdat[i+2])) & 0xff
+		a3 = (paethPredictor(a3, b3, c3) + int(cdat[i+3])) & 0xff
+		a4 = (paethPredictor(a4, b4, c4) + int(cdat[i+4])) & 0xff
+		a5 = (paethPredictor(a5, b5, c5) + int(cdat[i+5])) & 0xff
+		a6 = (paethPredictor(a6, b6, c6) + int(cdat[i+6])) & 0xff
+		a7 = (paethPredictor(a7, b7, c7) + int(cdat[i+7])) & 0xff
+		cdat[i+0], cdat[i+1], cdat[i+2], cdat[i+3] = uint8(a0), uint8(a1), uint8(a2), uint8(a3)
+		cdat[i+4], cdat[i+5], cdat[i+6], cdat[i+7] = uint8(a4), uint8(a5), uint8(a6), uint8(a7)
+		c0, c1, c2, c3, c4, c5, c6, c7 = b0, b1, b2, b3, b4, b5, b6, b7
+	}
+}
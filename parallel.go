@@ -0,0 +1,254 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// frameResult is the compressed image data of one frame.
+type frameResult struct {
+	data []byte
+	err  error
+}
+
+// frameCompressor compresses the image data of an animation's frames on
+// several goroutines, a bounded number of frames ahead of the encoder that
+// writes them in order.
+type frameCompressor struct {
+	results []chan frameResult
+	// window has a slot for each frame being compressed or waiting to be
+	// written, which limits how much compressed data is held at once.
+	window chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startCompression starts compressing the image data of every frame of e.a
+// on the given number of goroutines. Each goroutine uses its own encoder,
+// taken from the BufferPool if there is one. stop must be called once the
+// results are no longer needed, and before e goes back to the BufferPool.
+func (e *encoder) startCompression(workers int) *frameCompressor {
+	// The goroutines only use copies of e's fields, so that they never
+	// share its buffers.
+	enc, frames, cb := e.enc, e.a.Frames, e.cb
+	useTransparent, transparent := e.useTransparent, e.transparent
+	ctx, done := e.ctx, e.done
+
+	fc := &frameCompressor{
+		results: make([]chan frameResult, len(frames)),
+		window:  make(chan struct{}, 2*workers),
+		done:    make(chan struct{}),
+	}
+	for i := range fc.results {
+		fc.results[i] = make(chan frameResult, 1)
+	}
+
+	jobs := make(chan int)
+	fc.wg.Add(1 + workers)
+	go func() {
+		defer fc.wg.Done()
+		defer close(jobs)
+		for i := range frames {
+			select {
+			case fc.window <- struct{}{}:
+			case <-fc.done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-fc.done:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer fc.wg.Done()
+			var we *encoder
+			if enc.BufferPool != nil {
+				we = (*encoder)(enc.BufferPool.Get())
+			}
+			if we == nil {
+				we = &encoder{}
+			}
+			we.enc = enc
+			we.cb = cb
+			we.useTransparent = useTransparent
+			we.transparent = transparent
+			we.ctx, we.done = ctx, done
+			for i := range jobs {
+				var b bytes.Buffer
+				err := we.writeImage(&b, frames[i].Image, cb, enc.CompressionLevel)
+				fc.results[i] <- frameResult{b.Bytes(), err}
+			}
+			we.ctx, we.done = nil, nil
+			if enc.BufferPool != nil {
+				enc.BufferPool.Put((*EncoderBuffer)(we))
+			}
+		}()
+	}
+	return fc
+}
+
+// wait returns the compressed image data of frame i, waiting for it if
+// needed. Frames must be waited for in order.
+func (fc *frameCompressor) wait(i int) ([]byte, error) {
+	r := <-fc.results[i]
+	<-fc.window
+	return r.data, r.err
+}
+
+// stop stops compressing frames that haven't been started yet, and waits for
+// the goroutines to finish the frames they have, so that none still uses the
+// BufferPool or CompressionWriter once Encode returns.
+func (fc *frameCompressor) stop() {
+	close(fc.done)
+	fc.wg.Wait()
+}
+
+// frameJob locates the image data of one frame, for DecodeAllParallel.
+type frameJob struct {
+	frame  int
+	stage  int
+	offset int64  // The offset of the data in the first IDAT or fdAT chunk.
+	length uint32 // The length of that data.
+	fdAT   bool
+	seq    [4]byte // The sequence number of that fdAT chunk.
+}
+
+// frameScan records the frameJobs found by a decoder in scanning mode.
+type frameScan struct {
+	r    *io.SectionReader
+	jobs []frameJob
+}
+
+// add records the image data of the chunk that d has just started reading,
+// unless it continues the data of a frame already recorded, and skips it.
+func (s *frameScan) add(d *decoder, fdAT bool) error {
+	if n := len(s.jobs); n == 0 || s.jobs[n-1].frame != d.frameIndex {
+		offset, err := s.r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		job := frameJob{frame: d.frameIndex, stage: d.stage, offset: offset, length: d.idatLength, fdAT: fdAT}
+		copy(job.seq[:], d.tmp[:4])
+		s.jobs = append(s.jobs, job)
+	}
+	return s.skip(int64(d.idatLength) + 4)
+}
+
+// skip skips n bytes of the input.
+func (s *frameScan) skip(n int64) error {
+	_, err := s.r.Seek(n, io.SeekCurrent)
+	return err
+}
+
+// decodeFrame decodes the image data located by job, using a copy of d's
+// header fields.
+func (d *decoder) decodeFrame(r io.ReaderAt, size int64, job frameJob) (image.Image, error) {
+	fd := &decoder{
+		r:              io.NewSectionReader(r, job.offset, size-job.offset),
+		crc:            crc32.NewIEEE(),
+		a:              d.a,
+		frameIndex:     job.frame,
+		depth:          d.depth,
+		palette:        d.palette,
+		cb:             d.cb,
+		stage:          job.stage,
+		idatLength:     job.length,
+		interlace:      d.interlace,
+		useTransparent: d.useTransparent,
+		transparent:    d.transparent,
+	}
+	if job.fdAT {
+		fd.crc.Write([]byte("fdAT"))
+		fd.crc.Write(job.seq[:])
+	} else {
+		fd.crc.Write([]byte("IDAT"))
+	}
+	img, err := fd.decode()
+	if err != nil {
+		return nil, err
+	}
+	return img, fd.verifyChecksum()
+}
+
+// DecodeAllParallel reads an APNG file of the given size from r and returns
+// it as an APNG, like DecodeAll. It first reads every chunk except the image
+// data, to find where each frame's data is, and then decodes the frames on
+// the given number of goroutines. A workers value below 1 means
+// runtime.GOMAXPROCS(0). The result is identical to that of DecodeAll.
+func DecodeAllParallel(r io.ReaderAt, size int64, workers int) (APNG, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	sr := io.NewSectionReader(r, 0, size)
+	d := &decoder{
+		r:    sr,
+		crc:  crc32.NewIEEE(),
+		a:    APNG{Frames: make([]Frame, 1)},
+		scan: &frameScan{r: sr},
+	}
+	d.a.Frames[0].IsDefault = true
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return d.a, err
+	}
+	var scanErr error
+	for d.stage != dsSeenIEND {
+		if err := d.parseChunk(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			scanErr = err
+			break
+		}
+	}
+
+	jobs := d.scan.jobs
+	images := make([]image.Image, len(jobs))
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				images[i], errs[i] = d.decodeFrame(r, size, jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	// Report the first error in file order, as DecodeAll would.
+	for i, job := range jobs {
+		if errs[i] != nil {
+			if errs[i] == io.EOF {
+				errs[i] = io.ErrUnexpectedEOF
+			}
+			return d.a, errs[i]
+		}
+		d.a.Frames[job.frame].Image = images[i]
+	}
+	if scanErr != nil {
+		return d.a, scanErr
+	}
+	d.setKeyframes()
+	return d.a, nil
+}
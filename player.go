@@ -0,0 +1,267 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"time"
+)
+
+// Browsers show frames with a delay of minBrowserDelay or less for
+// browserDelay instead, for the Player's ClampDelays.
+const (
+	minBrowserDelay = 10 * time.Millisecond
+	browserDelay    = 100 * time.Millisecond
+)
+
+// Player plays an APNG, keeping track of which composited frame is shown as
+// time passes. Frames are composited only when they are shown, and a
+// bounded number of them are cached, so that seeking back or looping does
+// not always mean compositing from the first frame. The APNG's Keyframes
+// are also used as starting points.
+type Player struct {
+	// ClampDelays makes frames with a delay of 10ms or less show for 100ms,
+	// as web browsers do, so that animations made for the web play at the
+	// same speed.
+	ClampDelays bool
+
+	// CacheSize is the largest number of composited frames kept to be shown
+	// again. Zero means 8.
+	CacheSize int
+
+	// LinearBlending composites frames with BLEND_OP_OVER in linear light
+	// rather than in sRGB as the APNG spec says, which avoids dark fringes
+	// around partly transparent edges. The result is still 16-bit sRGB.
+	LinearBlending bool
+
+	a APNG
+	// first is the index in a.Frames of the first frame of the animation,
+	// and static reports that there is no animation to play, only a
+	// default image, if any.
+	first  int
+	static bool
+
+	frame    int
+	elapsed  time.Duration // How long the current frame has been shown.
+	plays    uint
+	paused   bool
+	finished bool
+
+	// c holds the canvas after frame drawn, which is -1 if c has to be reset
+	// before drawing.
+	c     *compositor
+	drawn int
+	cache []playerFrame
+	tick  uint64
+}
+
+// playerFrame is a composited frame in the Player's cache, with what is
+// needed to continue compositing from it.
+type playerFrame struct {
+	frame     int
+	canvas    *image.NRGBA64
+	last      image.Rectangle
+	disposeOp byte
+	used      uint64
+}
+
+// NewPlayer returns a Player that starts playing a from its first frame.
+func NewPlayer(a APNG) *Player {
+	p := &Player{a: a, drawn: -1}
+	if len(a.Frames) > 0 && a.Frames[0].IsDefault {
+		p.first = 1
+	}
+	if p.first >= len(a.Frames) {
+		p.first = 0
+		p.static = true
+	} else {
+		b := a.Frames[0].Image.Bounds()
+		p.c = newCompositor(b.Dx(), b.Dy())
+	}
+	p.Seek(0)
+	return p
+}
+
+// Update advances the animation by dt, unless it is paused or finished.
+func (p *Player) Update(dt time.Duration) {
+	if p.paused || p.finished || dt <= 0 {
+		return
+	}
+	p.elapsed += dt
+	p.advance()
+}
+
+// Seek moves the animation to time t after it started, counting each play,
+// as APNG.FrameAt does. A negative t is treated as 0. Seeking to before the
+// end of the last play makes a finished animation play again.
+func (p *Player) Seek(t time.Duration) {
+	if t < 0 {
+		t = 0
+	}
+	p.frame, p.elapsed, p.plays, p.finished = p.first, t, 0, false
+	p.advance()
+}
+
+// Pause stops the animation until Resume is called.
+func (p *Player) Pause() { p.paused = true }
+
+// Resume continues a paused animation.
+func (p *Player) Resume() { p.paused = false }
+
+// Paused reports whether the animation is paused.
+func (p *Player) Paused() bool { return p.paused }
+
+// Finished reports whether the animation has been played LoopCount times,
+// and stays on its last frame. An animation with a LoopCount of 0 never
+// finishes. An APNG that isn't animated is always finished.
+func (p *Player) Finished() bool { return p.finished }
+
+// Frame returns the index in the APNG's Frames of the frame shown.
+func (p *Player) Frame() int { return p.frame }
+
+// Current returns the canvas as it is shown, with every frame up to the
+// current one composited. It must not be modified, and is only valid until
+// the next call to Current. For an APNG that isn't animated, it is the
+// default image. It returns nil if the APNG has no frames.
+func (p *Player) Current() image.Image {
+	if p.static {
+		if len(p.a.Frames) == 0 {
+			return nil
+		}
+		return p.a.Frames[0].Image
+	}
+	return p.composite(p.frame)
+}
+
+// duration returns how long frame i is shown.
+func (p *Player) duration(i int) time.Duration {
+	d := p.a.Frames[i].Duration()
+	if p.ClampDelays && d <= minBrowserDelay {
+		d = browserDelay
+	}
+	return d
+}
+
+// advance moves on from the current frame for as long as p.elapsed covers
+// the frames' durations.
+func (p *Player) advance() {
+	last := len(p.a.Frames) - 1
+	if p.static {
+		p.frame, p.elapsed, p.finished = last, 0, true
+		return
+	}
+	var total time.Duration
+	for i := p.first; i <= last; i++ {
+		total += p.duration(i)
+	}
+	if total == 0 {
+		// Every frame is shown for no time at all, so the last one stays.
+		p.frame, p.elapsed, p.finished = last, 0, p.a.LoopCount != 0
+		return
+	}
+	loops := p.a.LoopCount
+	for {
+		d := p.duration(p.frame)
+		if p.elapsed < d {
+			return
+		}
+		p.elapsed -= d
+		if p.frame < last {
+			p.frame++
+			continue
+		}
+		// The end of a play. Whole plays are skipped at once.
+		n := 1 + uint64(p.elapsed/total)
+		if loops != 0 && uint64(p.plays)+n >= uint64(loops) {
+			p.plays, p.elapsed, p.finished = loops, 0, true
+			return
+		}
+		p.plays += uint(n)
+		p.elapsed -= time.Duration(n-1) * total
+		p.frame = p.first
+	}
+}
+
+// composite returns the canvas after frame i, from the cache if it is there.
+// Otherwise, it composites frames from the closest point it can start from:
+// the compositor, a cached frame or a keyframe.
+func (p *Player) composite(i int) *image.NRGBA64 {
+	if p.c.linear != p.LinearBlending {
+		// Nothing composited so far can be used.
+		p.c.linear = p.LinearBlending
+		p.cache = p.cache[:0]
+		p.drawn = -1
+	}
+	p.tick++
+	var from *playerFrame
+	for j := range p.cache {
+		e := &p.cache[j]
+		if e.frame == i {
+			e.used = p.tick
+			return e.canvas
+		}
+		// A frame disposed of with DISPOSE_OP_PREVIOUS needs the canvas
+		// from before it, which isn't cached.
+		if e.frame < i && e.disposeOp != DISPOSE_OP_PREVIOUS && (from == nil || e.frame > from.frame) {
+			from = e
+		}
+	}
+
+	// next is the first frame to draw, after resetting the canvas unless the
+	// compositor or a cached frame is continued from.
+	next, reset := p.first, true
+	for _, k := range p.a.Keyframes {
+		// A keyframe covers the whole canvas, but disposing of it with
+		// DISPOSE_OP_PREVIOUS needs the canvas from before it.
+		if k > next && k <= i && p.a.Frames[k].DisposeOp != DISPOSE_OP_PREVIOUS {
+			next = k
+		}
+	}
+	if from != nil && from.frame+1 > next {
+		next = from.frame + 1
+	} else {
+		from = nil
+	}
+	if p.drawn >= 0 && p.drawn <= i && p.drawn+1 >= next {
+		next, reset, from = p.drawn+1, false, nil
+	}
+	if from != nil {
+		copy(p.c.canvas.Pix, from.canvas.Pix)
+		p.c.last, p.c.disposeOp, p.c.drawn = from.last, from.disposeOp, 1
+		reset = false
+	}
+	if reset {
+		p.c.reset()
+	}
+	for j := next; j <= i; j++ {
+		p.c.draw(p.a.Frames[j])
+	}
+	p.drawn = i
+	return p.store(i)
+}
+
+// store adds a copy of the compositor's canvas to the cache as frame i,
+// replacing the least recently used frame if the cache is full.
+func (p *Player) store(i int) *image.NRGBA64 {
+	size := p.CacheSize
+	if size <= 0 {
+		size = 8
+	}
+	var e *playerFrame
+	if len(p.cache) < size {
+		p.cache = append(p.cache, playerFrame{canvas: image.NewNRGBA64(p.c.canvas.Rect)})
+		e = &p.cache[len(p.cache)-1]
+	} else {
+		e = &p.cache[0]
+		for j := range p.cache {
+			if p.cache[j].used < e.used {
+				e = &p.cache[j]
+			}
+		}
+	}
+	copy(e.canvas.Pix, p.c.canvas.Pix)
+	e.frame, e.last, e.disposeOp, e.used = i, p.c.last, p.c.disposeOp, p.tick
+	return e.canvas
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPlayer(t *testing.T) {
+	// Delta frames with keyframes use every DisposeOp and BlendOp, and give
+	// the player keyframes to start from.
+	a := movingSquare(12, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	a.Frames = append([]Frame{{Image: a.Frames[0].Image, IsDefault: true}}, a.Frames...)
+	var buf bytes.Buffer
+	if err := (&Encoder{KeyframeInterval: KeyframeInterval{Frames: 4}}).Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := composite(b)
+
+	r := rand.New(rand.NewSource(1))
+	for _, cacheSize := range []int{1, 3, 0} {
+		p := NewPlayer(b)
+		p.CacheSize = cacheSize
+		for n := 0; n < 200; n++ {
+			switch r.Intn(3) {
+			case 0:
+				t0 := time.Duration(r.Int63n(int64(3 * b.TotalDuration())))
+				p.Seek(t0)
+				if p.Frame() != b.FrameAt(t0) {
+					t.Fatalf("seeking to %v: got frame %d, want %d", t0, p.Frame(), b.FrameAt(t0))
+				}
+			default:
+				p.Update(time.Duration(r.Intn(100)) * time.Millisecond)
+			}
+			i := p.Frame()
+			if i == 0 {
+				t.Fatal("the default image was played")
+			}
+			if err := diff(want[i-1], p.Current()); err != nil {
+				t.Fatalf("cache size %d: frame %d: %v", cacheSize, i, err)
+			}
+		}
+	}
+}
+
+func TestPlayerTimeline(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 2, 2))
+	a := APNG{
+		LoopCount: 2,
+		Frames: []Frame{
+			{Image: m, DelayNumerator: 1},  // 10ms.
+			{Image: m, DelayNumerator: 20}, // 200ms.
+		},
+	}
+	p := NewPlayer(a)
+	p.Update(5 * time.Millisecond)
+	if p.Frame() != 0 {
+		t.Errorf("got frame %d after 5ms, want 0", p.Frame())
+	}
+	p.Update(5 * time.Millisecond)
+	if p.Frame() != 1 {
+		t.Errorf("got frame %d after 10ms, want 1", p.Frame())
+	}
+
+	p.Pause()
+	p.Update(time.Second)
+	if p.Frame() != 1 || p.Finished() {
+		t.Errorf("a paused player moved on to frame %d", p.Frame())
+	}
+	p.Resume()
+	p.Update(200 * time.Millisecond)
+	if p.Frame() != 0 || p.Finished() {
+		t.Errorf("got frame %d, finished %v at the start of the second play", p.Frame(), p.Finished())
+	}
+	p.Update(210 * time.Millisecond)
+	if p.Frame() != 1 || !p.Finished() {
+		t.Errorf("got frame %d, finished %v after two plays", p.Frame(), p.Finished())
+	}
+	p.Seek(215 * time.Millisecond)
+	if p.Frame() != 0 || p.Finished() {
+		t.Errorf("got frame %d, finished %v after seeking into the second play", p.Frame(), p.Finished())
+	}
+
+	// Browsers show the first frame for 100ms.
+	p = NewPlayer(a)
+	p.ClampDelays = true
+	p.Update(50 * time.Millisecond)
+	if p.Frame() != 0 {
+		t.Errorf("clamped: got frame %d after 50ms, want 0", p.Frame())
+	}
+	p.Update(50 * time.Millisecond)
+	if p.Frame() != 1 {
+		t.Errorf("clamped: got frame %d after 100ms, want 1", p.Frame())
+	}
+
+	// A PNG that isn't animated.
+	p = NewPlayer(APNG{Frames: []Frame{{Image: m, IsDefault: true}}})
+	if p.Current() != m || !p.Finished() {
+		t.Errorf("a PNG that isn't animated isn't shown as is")
+	}
+}
+
+func TestPlayerLinearBlending(t *testing.T) {
+	black := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	black.Pix = []uint8{0, 0, 0, 0xff, 0, 0, 0, 0xff}
+	// Half transparent white, and fully transparent.
+	edge := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	edge.Pix = []uint8{0xff, 0xff, 0xff, 0x80, 0x12, 0x34, 0x56, 0}
+	a := APNG{Frames: []Frame{
+		{Image: black, DelayNumerator: 1},
+		{Image: edge, BlendOp: BLEND_OP_OVER, DelayNumerator: 1},
+	}}
+
+	tests := []struct {
+		linear bool
+		gray   uint16
+	}{
+		// 0x80 of 0xff, in sRGB.
+		{false, 0x8080},
+		// Half the light of white is about 73.6% in sRGB.
+		{true, 0xbc94},
+	}
+	p := NewPlayer(a)
+	p.Seek(10 * time.Millisecond)
+	for _, test := range tests {
+		p.LinearBlending = test.linear
+		m := p.Current().(*image.NRGBA64)
+		c := m.NRGBA64At(0, 0)
+		if c.R != test.gray || c.G != test.gray || c.B != test.gray || c.A != 0xffff {
+			t.Errorf("linear %v: got %v, want gray %#04x", test.linear, c, test.gray)
+		}
+		if c := m.NRGBA64At(1, 0); c.R != 0 || c.A != 0xffff {
+			t.Errorf("linear %v: a transparent pixel changed the canvas to %v", test.linear, c)
+		}
+	}
+}
@@ -12,7 +12,9 @@
 package apng
 
 import (
+	"bufio"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"hash"
@@ -118,8 +120,46 @@ type decoder struct {
 	cb            int
 	stage         int
 	idatLength    uint32
-	tmp           [3 * 256]byte
-	interlace     int
+	// keyframes holds the frame numbers of the kfIX chunk. As the chunk is
+	// private and ancillary, one that is out of place or malformed is
+	// ignored, along with any other, by setting badkfIX.
+	keyframes []uint32
+	seenkfIX  bool
+	badkfIX   bool
+	// scan, if not nil, makes the decoder record where each frame's image
+	// data is instead of decoding it, for DecodeAllParallel.
+	scan *frameScan
+
+	// zr, br, cr, pr and passes are kept between frames, and between images
+	// when the decoder comes from a DecoderBufferPool. zr is the zlib reader,
+	// br buffers its input, as zlib would otherwise allocate a buffer each
+	// time, cr and pr are the current and previous rows, and passes holds the
+	// images of each Adam7 pass.
+	zr     io.ReadCloser
+	br     *bufio.Reader
+	cr, pr []uint8
+	passes [7]image.Image
+	// decompress is the Decoder's DecompressionReader, and zrCustom reports
+	// whether zr was made by it rather than by compress/zlib. A zr made by
+	// a DecompressionReader is only reused within one image, as the next
+	// Decoder to get the buffer from the pool may have another.
+	decompress func(r io.Reader) (io.ReadCloser, error)
+	zrCustom   bool
+
+	// ctx is checked between chunks and rows through done, which is nil if
+	// ctx can never be done. progress is reported to progressFunc, the
+	// Decoder's Progress, with the bytes read through count.
+	ctx          context.Context
+	done         <-chan struct{}
+	progress     Progress
+	progressFunc func(Progress)
+	count        readCounter
+	// reuse holds the images of the frames of the APNG being decoded into,
+	// from before decoding, which are reused if they fit.
+	reuse []image.Image
+
+	tmp       [3 * 256]byte
+	interlace int
 
 	// useTransparent and transparent are used for grayscale and truecolor
 	// transparency, as opposed to palette transparency.
@@ -127,6 +167,35 @@ type decoder struct {
 	transparent    [6]byte
 }
 
+// Decoder configures decoding APNG images.
+type Decoder struct {
+	// BufferPool optionally specifies a buffer pool to get temporary
+	// DecoderBuffers when decoding an image.
+	BufferPool DecoderBufferPool
+
+	// DecompressionReader optionally provides an external zlib decompression
+	// reader for reading PNG image data, mirroring the Encoder's
+	// CompressionWriter. The reader must verify the zlib checksum, and return
+	// io.EOF at the end of the data. If it implements zlib.Resetter, it is
+	// reset and reused for the following frames of the same image instead
+	// of calling DecompressionReader again.
+	DecompressionReader func(r io.Reader) (io.ReadCloser, error)
+
+	// Progress, if not nil, is called after each chunk is read.
+	Progress func(Progress)
+}
+
+// DecoderBufferPool is an interface for getting and returning temporary
+// instances of the DecoderBuffer struct. This can be used to reuse buffers
+// when decoding multiple images.
+type DecoderBufferPool interface {
+	Get() *DecoderBuffer
+	Put(*DecoderBuffer)
+}
+
+// DecoderBuffer holds the buffers used for decoding APNG images.
+type DecoderBuffer decoder
+
 // A FormatError reports that the input is not a valid PNG.
 type FormatError string
 
@@ -383,10 +452,26 @@ func (d *decoder) Read(p []byte) (int, error) {
 
 // decode decodes the IDAT data into an image.
 func (d *decoder) decode() (image.Image, error) {
-	r, err := zlib.NewReader(d)
+	if d.br == nil {
+		d.br = bufio.NewReader(d)
+	} else {
+		d.br.Reset(d)
+	}
+	var err error
+	custom := d.decompress != nil
+	if rs, ok := d.zr.(zlib.Resetter); ok && d.zrCustom == custom {
+		err = rs.Reset(d.br, nil)
+	} else if custom {
+		d.zr, err = d.decompress(d.br)
+	} else {
+		d.zr, err = zlib.NewReader(d.br)
+	}
+	d.zrCustom = custom
 	if err != nil {
+		d.zr = nil
 		return nil, err
 	}
+	r := d.zr
 	defer r.Close()
 	var img image.Image
 	if d.interlace == itNone {
@@ -432,7 +517,6 @@ func (d *decoder) decode() (image.Image, error) {
 // readImagePass reads a single image pass, sized according to the pass number.
 func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image.Image, error) {
 	bitsPerPixel := 0
-	pixOffset := 0
 	var (
 		gray     *image.Gray
 		rgba     *image.RGBA
@@ -459,64 +543,75 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 			return nil, nil
 		}
 	}
+	// reuse is an image that is reused if it has the right type and size:
+	// the scratch image of the pass, or the frame's image from before.
+	var reuse image.Image
+	if d.interlace == itAdam7 && !allocateOnly {
+		reuse = d.passes[pass]
+	} else if d.frameIndex < len(d.reuse) {
+		reuse = d.reuse[d.frameIndex]
+	}
 	switch d.cb {
 	case cbG1, cbG2, cbG4, cbG8:
 		bitsPerPixel = d.depth
 		if d.useTransparent {
-			nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+			nrgba = reuseNRGBA(reuse, width, height)
 			img = nrgba
 		} else {
-			gray = image.NewGray(image.Rect(0, 0, width, height))
+			gray = reuseGray(reuse, width, height)
 			img = gray
 		}
 	case cbGA8:
 		bitsPerPixel = 16
-		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		nrgba = reuseNRGBA(reuse, width, height)
 		img = nrgba
 	case cbTC8:
 		bitsPerPixel = 24
 		if d.useTransparent {
-			nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+			nrgba = reuseNRGBA(reuse, width, height)
 			img = nrgba
 		} else {
-			rgba = image.NewRGBA(image.Rect(0, 0, width, height))
+			rgba = reuseRGBA(reuse, width, height)
 			img = rgba
 		}
 	case cbP1, cbP2, cbP4, cbP8:
 		bitsPerPixel = d.depth
-		paletted = image.NewPaletted(image.Rect(0, 0, width, height), d.palette)
+		paletted = reusePaletted(reuse, width, height, d.palette)
 		img = paletted
 	case cbTCA8:
 		bitsPerPixel = 32
-		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		nrgba = reuseNRGBA(reuse, width, height)
 		img = nrgba
 	case cbG16:
 		bitsPerPixel = 16
 		if d.useTransparent {
-			nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
+			nrgba64 = reuseNRGBA64(reuse, width, height)
 			img = nrgba64
 		} else {
-			gray16 = image.NewGray16(image.Rect(0, 0, width, height))
+			gray16 = reuseGray16(reuse, width, height)
 			img = gray16
 		}
 	case cbGA16:
 		bitsPerPixel = 32
-		nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
+		nrgba64 = reuseNRGBA64(reuse, width, height)
 		img = nrgba64
 	case cbTC16:
 		bitsPerPixel = 48
 		if d.useTransparent {
-			nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
+			nrgba64 = reuseNRGBA64(reuse, width, height)
 			img = nrgba64
 		} else {
-			rgba64 = image.NewRGBA64(image.Rect(0, 0, width, height))
+			rgba64 = reuseRGBA64(reuse, width, height)
 			img = rgba64
 		}
 	case cbTCA16:
 		bitsPerPixel = 64
-		nrgba64 = image.NewNRGBA64(image.Rect(0, 0, width, height))
+		nrgba64 = reuseNRGBA64(reuse, width, height)
 		img = nrgba64
 	}
+	if d.interlace == itAdam7 && !allocateOnly {
+		d.passes[pass] = img
+	}
 	if allocateOnly {
 		return img, nil
 	}
@@ -528,10 +623,19 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 		return nil, UnsupportedError("dimension overflow")
 	}
 	// cr and pr are the bytes for the current and previous row.
-	cr := make([]uint8, rowSize)
-	pr := make([]uint8, rowSize)
+	if int64(cap(d.cr)) < rowSize {
+		d.cr = make([]uint8, rowSize)
+		d.pr = make([]uint8, rowSize)
+	}
+	cr := d.cr[:rowSize]
+	pr := d.pr[:rowSize]
+	zeroMemory(pr)
 
 	for y := 0; y < height; y++ {
+		if err := d.canceled(); err != nil {
+			return nil, err
+		}
+
 		// Read the decompressed bytes.
 		_, err := io.ReadFull(r, cr)
 		if err != nil {
@@ -544,194 +648,98 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 		// Apply the filter.
 		cdat := cr[1:]
 		pdat := pr[1:]
-		switch cr[0] {
-		case ftNone:
-			// No-op.
-		case ftSub:
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += cdat[i-bytesPerPixel]
-			}
-		case ftUp:
-			for i, p := range pdat {
-				cdat[i] += p
-			}
-		case ftAverage:
-			// The first column has no column to the left of it, so it is a
-			// special case. We know that the first column exists because we
-			// check above that width != 0, and so len(cdat) != 0.
-			for i := 0; i < bytesPerPixel; i++ {
-				cdat[i] += pdat[i] / 2
-			}
-			for i := bytesPerPixel; i < len(cdat); i++ {
-				cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
-			}
-		case ftPaeth:
-			filterPaeth(cdat, pdat, bytesPerPixel)
-		default:
+		if !unfilter(cr[0], cdat, pdat, bytesPerPixel) {
 			return nil, FormatError("bad filter type")
 		}
 
-		// Convert from bytes to colors.
+		// Convert from bytes to colors, writing straight to the image's Pix.
 		switch d.cb {
-		case cbG1:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x += 8 {
-					b := cdat[x/8]
-					for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-						ycol := (b >> 7) * 0xff
-						acol := uint8(0xff)
-						if ycol == ty {
-							acol = 0x00
-						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 1
-					}
-				}
-			} else {
-				for x := 0; x < width; x += 8 {
-					b := cdat[x/8]
-					for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 7) * 0xff})
-						b <<= 1
-					}
-				}
-			}
-		case cbG2:
-			if d.useTransparent {
-				ty := d.transparent[1]
-				for x := 0; x < width; x += 4 {
-					b := cdat[x/4]
-					for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-						ycol := (b >> 6) * 0x55
-						acol := uint8(0xff)
-						if ycol == ty {
-							acol = 0x00
-						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 2
-					}
-				}
-			} else {
-				for x := 0; x < width; x += 4 {
-					b := cdat[x/4]
-					for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 6) * 0x55})
-						b <<= 2
-					}
-				}
-			}
-		case cbG4:
+		case cbG1, cbG2, cbG4:
+			depth := uint(d.depth)
+			pixelsPerByte := 8 / int(depth)
+			scale := uint8(0xff / (1<<depth - 1))
 			if d.useTransparent {
 				ty := d.transparent[1]
-				for x := 0; x < width; x += 2 {
-					b := cdat[x/2]
-					for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-						ycol := (b >> 4) * 0x11
+				row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*width]
+				for x := 0; x < width; x += pixelsPerByte {
+					b := cdat[x/pixelsPerByte]
+					for x2 := 0; x2 < pixelsPerByte && x+x2 < width; x2++ {
+						ycol := (b >> (8 - depth)) * scale
 						acol := uint8(0xff)
 						if ycol == ty {
 							acol = 0x00
 						}
-						nrgba.SetNRGBA(x+x2, y, color.NRGBA{ycol, ycol, ycol, acol})
-						b <<= 4
+						i := 4 * (x + x2)
+						row[i+0], row[i+1], row[i+2], row[i+3] = ycol, ycol, ycol, acol
+						b <<= depth
 					}
 				}
 			} else {
-				for x := 0; x < width; x += 2 {
-					b := cdat[x/2]
-					for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-						gray.SetGray(x+x2, y, color.Gray{(b >> 4) * 0x11})
-						b <<= 4
+				row := gray.Pix[y*gray.Stride : y*gray.Stride+width]
+				for x := 0; x < width; x += pixelsPerByte {
+					b := cdat[x/pixelsPerByte]
+					for x2 := 0; x2 < pixelsPerByte && x+x2 < width; x2++ {
+						row[x+x2] = (b >> (8 - depth)) * scale
+						b <<= depth
 					}
 				}
 			}
 		case cbG8:
 			if d.useTransparent {
 				ty := d.transparent[1]
-				for x := 0; x < width; x++ {
-					ycol := cdat[x]
+				row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*width]
+				for x, ycol := range cdat[:width] {
 					acol := uint8(0xff)
 					if ycol == ty {
 						acol = 0x00
 					}
-					nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, acol})
+					row[4*x+0], row[4*x+1], row[4*x+2], row[4*x+3] = ycol, ycol, ycol, acol
 				}
 			} else {
-				copy(gray.Pix[pixOffset:], cdat)
-				pixOffset += gray.Stride
+				copy(gray.Pix[y*gray.Stride:], cdat[:width])
 			}
 		case cbGA8:
+			row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*width]
 			for x := 0; x < width; x++ {
 				ycol := cdat[2*x+0]
-				nrgba.SetNRGBA(x, y, color.NRGBA{ycol, ycol, ycol, cdat[2*x+1]})
+				row[4*x+0], row[4*x+1], row[4*x+2], row[4*x+3] = ycol, ycol, ycol, cdat[2*x+1]
 			}
 		case cbTC8:
 			if d.useTransparent {
-				pix, i, j := nrgba.Pix, pixOffset, 0
+				row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+4*width]
 				tr, tg, tb := d.transparent[1], d.transparent[3], d.transparent[5]
-				for x := 0; x < width; x++ {
-					r := cdat[j+0]
-					g := cdat[j+1]
-					b := cdat[j+2]
+				for i, j := 0, 0; i < len(row); i, j = i+4, j+3 {
+					r, g, b := cdat[j+0], cdat[j+1], cdat[j+2]
 					a := uint8(0xff)
 					if r == tr && g == tg && b == tb {
 						a = 0x00
 					}
-					pix[i+0] = r
-					pix[i+1] = g
-					pix[i+2] = b
-					pix[i+3] = a
-					i += 4
-					j += 3
+					row[i+0], row[i+1], row[i+2], row[i+3] = r, g, b, a
 				}
-				pixOffset += nrgba.Stride
 			} else {
-				pix, i, j := rgba.Pix, pixOffset, 0
-				for x := 0; x < width; x++ {
-					pix[i+0] = cdat[j+0]
-					pix[i+1] = cdat[j+1]
-					pix[i+2] = cdat[j+2]
-					pix[i+3] = 0xff
-					i += 4
-					j += 3
+				row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+4*width]
+				for i, j := 0, 0; i < len(row); i, j = i+4, j+3 {
+					row[i+0], row[i+1], row[i+2], row[i+3] = cdat[j+0], cdat[j+1], cdat[j+2], 0xff
 				}
-				pixOffset += rgba.Stride
 			}
-		case cbP1:
-			for x := 0; x < width; x += 8 {
-				b := cdat[x/8]
-				for x2 := 0; x2 < 8 && x+x2 < width; x2++ {
-					idx := b >> 7
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
+		case cbP1, cbP2, cbP4:
+			depth := uint(d.depth)
+			pixelsPerByte := 8 / int(depth)
+			row := paletted.Pix[y*paletted.Stride : y*paletted.Stride+width]
+			maxIdx := uint8(0)
+			for x := 0; x < width; x += pixelsPerByte {
+				b := cdat[x/pixelsPerByte]
+				for x2 := 0; x2 < pixelsPerByte && x+x2 < width; x2++ {
+					idx := b >> (8 - depth)
+					if idx > maxIdx {
+						maxIdx = idx
 					}
-					paletted.SetColorIndex(x+x2, y, idx)
-					b <<= 1
+					row[x+x2] = idx
+					b <<= depth
 				}
 			}
-		case cbP2:
-			for x := 0; x < width; x += 4 {
-				b := cdat[x/4]
-				for x2 := 0; x2 < 4 && x+x2 < width; x2++ {
-					idx := b >> 6
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
-					}
-					paletted.SetColorIndex(x+x2, y, idx)
-					b <<= 2
-				}
-			}
-		case cbP4:
-			for x := 0; x < width; x += 2 {
-				b := cdat[x/2]
-				for x2 := 0; x2 < 2 && x+x2 < width; x2++ {
-					idx := b >> 4
-					if len(paletted.Palette) <= int(idx) {
-						paletted.Palette = paletted.Palette[:int(idx)+1]
-					}
-					paletted.SetColorIndex(x+x2, y, idx)
-					b <<= 4
-				}
+			if len(paletted.Palette) <= int(maxIdx) {
+				paletted.Palette = paletted.Palette[:int(maxIdx)+1]
 			}
 		case cbP8:
 			if len(paletted.Palette) != 256 {
@@ -741,65 +749,58 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 					}
 				}
 			}
-			copy(paletted.Pix[pixOffset:], cdat)
-			pixOffset += paletted.Stride
+			copy(paletted.Pix[y*paletted.Stride:], cdat[:width])
 		case cbTCA8:
-			copy(nrgba.Pix[pixOffset:], cdat)
-			pixOffset += nrgba.Stride
+			copy(nrgba.Pix[y*nrgba.Stride:], cdat[:4*width])
 		case cbG16:
 			if d.useTransparent {
-				ty := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
+				ty0, ty1 := d.transparent[0], d.transparent[1]
+				row := nrgba64.Pix[y*nrgba64.Stride : y*nrgba64.Stride+8*width]
 				for x := 0; x < width; x++ {
-					ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
-					acol := uint16(0xffff)
-					if ycol == ty {
-						acol = 0x0000
+					y0, y1 := cdat[2*x+0], cdat[2*x+1]
+					a := uint8(0xff)
+					if y0 == ty0 && y1 == ty1 {
+						a = 0x00
 					}
-					nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+					i := 8 * x
+					row[i+0], row[i+1], row[i+2], row[i+3] = y0, y1, y0, y1
+					row[i+4], row[i+5], row[i+6], row[i+7] = y0, y1, a, a
 				}
 			} else {
-				for x := 0; x < width; x++ {
-					ycol := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
-					gray16.SetGray16(x, y, color.Gray16{ycol})
-				}
+				// Gray16 pixels are big-endian, like PNG samples.
+				copy(gray16.Pix[y*gray16.Stride:], cdat[:2*width])
 			}
 		case cbGA16:
+			row := nrgba64.Pix[y*nrgba64.Stride : y*nrgba64.Stride+8*width]
 			for x := 0; x < width; x++ {
-				ycol := uint16(cdat[4*x+0])<<8 | uint16(cdat[4*x+1])
-				acol := uint16(cdat[4*x+2])<<8 | uint16(cdat[4*x+3])
-				nrgba64.SetNRGBA64(x, y, color.NRGBA64{ycol, ycol, ycol, acol})
+				y0, y1 := cdat[4*x+0], cdat[4*x+1]
+				i := 8 * x
+				row[i+0], row[i+1], row[i+2], row[i+3] = y0, y1, y0, y1
+				row[i+4], row[i+5], row[i+6], row[i+7] = y0, y1, cdat[4*x+2], cdat[4*x+3]
 			}
 		case cbTC16:
 			if d.useTransparent {
-				tr := uint16(d.transparent[0])<<8 | uint16(d.transparent[1])
-				tg := uint16(d.transparent[2])<<8 | uint16(d.transparent[3])
-				tb := uint16(d.transparent[4])<<8 | uint16(d.transparent[5])
-				for x := 0; x < width; x++ {
-					rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
-					gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
-					bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
-					acol := uint16(0xffff)
-					if rcol == tr && gcol == tg && bcol == tb {
-						acol = 0x0000
+				t := d.transparent
+				row := nrgba64.Pix[y*nrgba64.Stride : y*nrgba64.Stride+8*width]
+				for i, j := 0, 0; i < len(row); i, j = i+8, j+6 {
+					c := cdat[j : j+6 : j+6]
+					a := uint8(0xff)
+					if string(c) == string(t[:]) {
+						a = 0x00
 					}
-					nrgba64.SetNRGBA64(x, y, color.NRGBA64{rcol, gcol, bcol, acol})
+					copy(row[i:i+6], c)
+					row[i+6], row[i+7] = a, a
 				}
 			} else {
-				for x := 0; x < width; x++ {
-					rcol := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
-					gcol := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
-					bcol := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
-					rgba64.SetRGBA64(x, y, color.RGBA64{rcol, gcol, bcol, 0xffff})
+				row := rgba64.Pix[y*rgba64.Stride : y*rgba64.Stride+8*width]
+				for i, j := 0, 0; i < len(row); i, j = i+8, j+6 {
+					copy(row[i:i+6], cdat[j:j+6])
+					row[i+6], row[i+7] = 0xff, 0xff
 				}
 			}
 		case cbTCA16:
-			for x := 0; x < width; x++ {
-				rcol := uint16(cdat[8*x+0])<<8 | uint16(cdat[8*x+1])
-				gcol := uint16(cdat[8*x+2])<<8 | uint16(cdat[8*x+3])
-				bcol := uint16(cdat[8*x+4])<<8 | uint16(cdat[8*x+5])
-				acol := uint16(cdat[8*x+6])<<8 | uint16(cdat[8*x+7])
-				nrgba64.SetNRGBA64(x, y, color.NRGBA64{rcol, gcol, bcol, acol})
-			}
+			// NRGBA64 pixels are big-endian, like PNG samples.
+			copy(nrgba64.Pix[y*nrgba64.Stride:], cdat[:8*width])
 		}
 
 		// The current row for y is the previous row for y+1.
@@ -809,6 +810,58 @@ func (d *decoder) readImagePass(r io.Reader, pass int, allocateOnly bool) (image
 	return img, nil
 }
 
+// reuseGray returns m if it is an *image.Gray with bounds (0, 0, w, h), or
+// else a new one. The other reuse functions do the same for other types.
+func reuseGray(m image.Image, w, h int) *image.Gray {
+	if m, ok := m.(*image.Gray); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewGray(image.Rect(0, 0, w, h))
+}
+
+func reuseNRGBA(m image.Image, w, h int) *image.NRGBA {
+	if m, ok := m.(*image.NRGBA); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewNRGBA(image.Rect(0, 0, w, h))
+}
+
+func reuseRGBA(m image.Image, w, h int) *image.RGBA {
+	if m, ok := m.(*image.RGBA); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewRGBA(image.Rect(0, 0, w, h))
+}
+
+func reusePaletted(m image.Image, w, h int, p color.Palette) *image.Paletted {
+	if m, ok := m.(*image.Paletted); ok && m.Rect == image.Rect(0, 0, w, h) {
+		m.Palette = p
+		return m
+	}
+	return image.NewPaletted(image.Rect(0, 0, w, h), p)
+}
+
+func reuseGray16(m image.Image, w, h int) *image.Gray16 {
+	if m, ok := m.(*image.Gray16); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewGray16(image.Rect(0, 0, w, h))
+}
+
+func reuseRGBA64(m image.Image, w, h int) *image.RGBA64 {
+	if m, ok := m.(*image.RGBA64); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewRGBA64(image.Rect(0, 0, w, h))
+}
+
+func reuseNRGBA64(m image.Image, w, h int) *image.NRGBA64 {
+	if m, ok := m.(*image.NRGBA64); ok && m.Rect == image.Rect(0, 0, w, h) {
+		return m
+	}
+	return image.NewNRGBA64(image.Rect(0, 0, w, h))
+}
+
 // mergePassInto merges a single pass into a full sized image.
 func (d *decoder) mergePassInto(dst image.Image, src image.Image, pass int) {
 	p := interlacing[pass]
@@ -891,6 +944,59 @@ func (d *decoder) parseacTL(length uint32) (err error) {
 	return d.verifyChecksum()
 }
 
+// parsekfIX parses the private kfIX chunk written by Encoder, which lists
+// the keyframes as increasing frame numbers counting from the first fcTL
+// chunk.
+func (d *decoder) parsekfIX(length uint32) (err error) {
+	if length%4 != 0 || length > 4*(1<<20) {
+		d.badkfIX = true
+		return d.ignoreChunk(length)
+	}
+	d.keyframes = d.keyframes[:0]
+	for ; length > 0; length -= 4 {
+		if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+			return err
+		}
+		d.crc.Write(d.tmp[:4])
+		k := binary.BigEndian.Uint32(d.tmp[:4])
+		if k >= d.numFrames || len(d.keyframes) > 0 && k <= d.keyframes[len(d.keyframes)-1] {
+			d.badkfIX = true
+		}
+		d.keyframes = append(d.keyframes, k)
+	}
+	return d.verifyChecksum()
+}
+
+// setKeyframes sets the APNG's Keyframes from the kfIX chunk, as indices in
+// Frames. They are left nil if the chunk was ignored, or if any is not a
+// frame that covers the whole canvas with BLEND_OP_SOURCE.
+func (d *decoder) setKeyframes() {
+	d.a.Keyframes = d.a.Keyframes[:0]
+	if d.badkfIX {
+		d.a.Keyframes = nil
+		return
+	}
+	first := 0
+	if d.a.Frames[0].IsDefault {
+		first = 1
+	}
+	for _, k := range d.keyframes {
+		if int64(k) >= int64(len(d.a.Frames)-first) {
+			d.a.Keyframes = nil
+			return
+		}
+		f, canvas := d.a.Frames[first+int(k)], d.a.Frames[0]
+		if f.XOffset != 0 || f.YOffset != 0 || f.width != canvas.width || f.height != canvas.height || f.BlendOp != BLEND_OP_SOURCE {
+			d.a.Keyframes = nil
+			return
+		}
+		d.a.Keyframes = append(d.a.Keyframes, first+int(k))
+	}
+	if len(d.a.Keyframes) == 0 {
+		d.a.Keyframes = nil
+	}
+}
+
 func (d *decoder) parsefcTL(length uint32) (err error) {
 	if length != 26 {
 		return FormatError("bad fcTL length")
@@ -923,19 +1029,29 @@ func (d *decoder) parsefdAT(length uint32) (err error) {
 	}
 	d.crc.Write(d.tmp[:4])
 	d.idatLength = length - 4
+	if d.scan != nil {
+		return d.scan.add(d, true)
+	}
 	d.a.Frames[d.frameIndex].Image, err = d.decode()
 	if err != nil {
 		return err
 	}
+	d.progress.Frames++
 	return d.verifyChecksum()
 }
 
 func (d *decoder) parseIDAT(length uint32) (err error) {
 	d.idatLength = length
+	if d.scan != nil {
+		return d.scan.add(d, false)
+	}
 	d.a.Frames[d.frameIndex].Image, err = d.decode()
 	if err != nil {
 		return err
 	}
+	if !d.a.Frames[d.frameIndex].IsDefault {
+		d.progress.Frames++
+	}
 	return d.verifyChecksum()
 }
 
@@ -984,6 +1100,13 @@ func (d *decoder) parseChunk() error {
 			return chunkOrderError
 		}
 		return d.parseacTL(length)
+	case "kfIX":
+		if d.stage >= dsSeenIDAT || d.seenkfIX {
+			d.badkfIX = true
+			return d.ignoreChunk(length)
+		}
+		d.seenkfIX = true
+		return d.parsekfIX(length)
 	case "fcTL":
 		if d.stage >= dsSeenIDAT {
 			d.frameIndex = d.frameIndex + 1
@@ -1004,6 +1127,9 @@ func (d *decoder) parseChunk() error {
 			// This does not affect valid PNG images that contain multiple IDAT
 			// chunks, since the first call to parseIDAT below will consume all
 			// consecutive IDAT chunks required for decoding the image.
+			if d.scan != nil {
+				return d.scan.skip(int64(length) + 4)
+			}
 			break
 		}
 		d.stage = dsSeenIDAT
@@ -1015,6 +1141,12 @@ func (d *decoder) parseChunk() error {
 		d.stage = dsSeenIEND
 		return d.parseIEND(length)
 	}
+	return d.ignoreChunk(length)
+}
+
+// ignoreChunk skips the data of a chunk of the given length, checking its
+// CRC.
+func (d *decoder) ignoreChunk(length uint32) error {
 	if length > 0x7fffffff {
 		return FormatError(fmt.Sprintf("Bad chunk length: %d", length))
 	}
@@ -1057,28 +1189,110 @@ func (d *decoder) checkHeader() error {
 // frame should not be part of the result.
 // The type of Image returned depends on the PNG contents.
 func DecodeAll(r io.Reader) (APNG, error) {
-	d := &decoder{
+	var dec Decoder
+	return dec.DecodeAll(r)
+}
+
+// DecodeAll reads an APNG file from r and returns it as an APNG, like the
+// DecodeAll function.
+func (dec *Decoder) DecodeAll(r io.Reader) (APNG, error) {
+	return dec.DecodeAllContext(context.Background(), r)
+}
+
+// DecodeAllContext reads an APNG file from r and returns it as an APNG, like
+// DecodeAll, but returns ctx.Err() as soon as ctx is done. It is checked
+// between chunks and rows.
+func (dec *Decoder) DecodeAllContext(ctx context.Context, r io.Reader) (APNG, error) {
+	var a APNG
+	err := dec.decodeInto(ctx, r, &a)
+	return a, err
+}
+
+// DecodeInto reads an APNG file from r into a, reusing the Frames and
+// Keyframes slices of a, and the image of each frame if it has the type and
+// size the frame decodes to. The images of a must not be shared between its
+// frames, or used elsewhere, as they are overwritten. Together with a
+// BufferPool, this lets an animation be decoded over and over without
+// allocating. If an error occurs, a holds what was decoded before it.
+func (dec *Decoder) DecodeInto(r io.Reader, a *APNG) error {
+	return dec.decodeInto(context.Background(), r, a)
+}
+
+// decodeInto is DecodeInto with a context.
+func (dec *Decoder) decodeInto(ctx context.Context, r io.Reader, a *APNG) error {
+	var d *decoder
+	if dec.BufferPool != nil {
+		d = (*decoder)(dec.BufferPool.Get())
+	}
+	if d == nil {
+		d = &decoder{}
+	}
+	if dec.BufferPool != nil {
+		defer dec.BufferPool.Put((*DecoderBuffer)(d))
+	}
+	crc := d.crc
+	if crc == nil {
+		crc = crc32.NewIEEE()
+	}
+	zr := d.zr
+	if d.zrCustom {
+		zr = nil
+	}
+	*d = decoder{
 		r:          r,
-		crc:        crc32.NewIEEE(),
-		frameIndex: 0,
-		a:          APNG{Frames: make([]Frame, 1)},
+		crc:        crc,
+		zr:         zr,
+		br:         d.br,
+		cr:         d.cr,
+		pr:         d.pr,
+		passes:     d.passes,
+		decompress: dec.DecompressionReader,
+		reuse:      d.reuse[:0],
+		ctx:        ctx,
+		done:       ctx.Done(),
+	}
+	if dec.Progress != nil {
+		d.progressFunc = dec.Progress
+		d.count.r = r
+		d.r = &d.count
 	}
-	d.a.Frames[0].IsDefault = true
+	for _, f := range a.Frames {
+		d.reuse = append(d.reuse, f.Image)
+	}
+	d.a = APNG{Frames: append(a.Frames[:0], Frame{IsDefault: true}), Keyframes: a.Keyframes[:0]}
+
+	err := d.decodeAll()
+	// Don't hold on to the images in the pool.
+	for i := range d.reuse {
+		d.reuse[i] = nil
+	}
+	d.r, d.count.r, d.ctx, d.done = nil, nil, nil, nil
+	*a = d.a
+	return err
+}
+
+// decodeAll decodes every chunk into d.a.
+func (d *decoder) decodeAll() error {
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
-		return d.a, err
+		return err
 	}
 	for d.stage != dsSeenIEND {
+		if err := d.canceled(); err != nil {
+			return err
+		}
 		if err := d.parseChunk(); err != nil {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
-			return d.a, err
+			return err
 		}
+		d.report()
 	}
-	return d.a, nil
+	d.setKeyframes()
+	return nil
 }
 
 // Decode reads an APNG file from r and returns the default image.
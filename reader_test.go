@@ -6,7 +6,14 @@ package apng
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
 	"image/color"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -112,6 +119,103 @@ func TestMultipletRNSChunks(t *testing.T) {
 	}
 }
 
+// pngChunks splits the PNG file b into its chunks, each with its length,
+// type and CRC.
+func pngChunks(b []byte) [][]byte {
+	var chunks [][]byte
+	for b = b[len(pngHeader):]; len(b) > 0; {
+		n := 12 + int(binary.BigEndian.Uint32(b))
+		chunks = append(chunks, b[:n])
+		b = b[n:]
+	}
+	return chunks
+}
+
+// pngChunk returns a chunk of the given type and data.
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	copy(b[8:], data)
+	binary.BigEndian.PutUint32(b[8+len(data):], crc32.ChecksumIEEE(b[4:8+len(data)]))
+	return b
+}
+
+func TestBadkfIX(t *testing.T) {
+	// The keyframes are frames 0 and 2, and frames 1 and 3 only cover the
+	// square.
+	a := movingSquare(4, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	var buf bytes.Buffer
+	if err := (&Encoder{KeyframeInterval: KeyframeInterval{Frames: 2}}).Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	var kfIX, idat int
+	chunks := pngChunks(buf.Bytes())
+	for i, c := range chunks {
+		switch string(c[4:8]) {
+		case "kfIX":
+			kfIX = i
+		case "IDAT":
+			idat = i
+		}
+	}
+	keyframes := func(ks ...uint32) []byte {
+		b := make([]byte, 4*len(ks))
+		for i, k := range ks {
+			binary.BigEndian.PutUint32(b[4*i:], k)
+		}
+		return pngChunk("kfIX", b)
+	}
+	// build returns the file with the kfIX chunk replaced by the given chunks
+	// at index at, counting without it.
+	build := func(at int, add ...[]byte) []byte {
+		rest := append(append([][]byte(nil), chunks[:kfIX]...), chunks[kfIX+1:]...)
+		b := []byte(pngHeader)
+		for i, c := range rest {
+			if i == at {
+				b = bytes.Join(append([][]byte{b}, add...), nil)
+			}
+			b = append(b, c...)
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"valid", build(kfIX, keyframes(0, 2)), true},
+		{"after IDAT", build(idat, keyframes(0, 2)), false},
+		{"twice", build(kfIX, keyframes(0), keyframes(2)), false},
+		{"out of range", build(kfIX, keyframes(0, 4)), false},
+		{"not a keyframe", build(kfIX, keyframes(0, 1)), false},
+		{"unsorted", build(kfIX, keyframes(2, 0)), false},
+		{"bad length", build(kfIX, pngChunk("kfIX", []byte{0, 0, 0, 0, 2})), false},
+		{"garbage", build(kfIX, pngChunk("kfIX", []byte("\xde\xad\xbe\xef\x01\x02\x03\x04"))), false},
+	}
+	// A bad kfIX chunk is ignored rather than failing the decode.
+	for _, test := range tests {
+		want := "[]"
+		if test.ok {
+			want = "[0 2]"
+		}
+		b, err := DecodeAll(bytes.NewReader(test.b))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if fmt.Sprint(b.Keyframes) != want || !test.ok && b.Keyframes != nil {
+			t.Errorf("%s: got keyframes %v, want %s", test.name, b.Keyframes, want)
+		} else if len(b.Frames) != 4 {
+			t.Errorf("%s: got %d frames, want 4", test.name, len(b.Frames))
+		}
+		b, err = DecodeAllParallel(bytes.NewReader(test.b), int64(len(test.b)), 2)
+		if err != nil {
+			t.Errorf("%s: DecodeAllParallel: %v", test.name, err)
+		} else if fmt.Sprint(b.Keyframes) != want || !test.ok && b.Keyframes != nil {
+			t.Errorf("%s: DecodeAllParallel: got keyframes %v, want %s", test.name, b.Keyframes, want)
+		}
+	}
+}
+
 func TestUnknownChunkLengthUnderflow(t *testing.T) {
 	data := []byte{0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0xff, 0xff,
 		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x06, 0xf4, 0x7c, 0x55, 0x04, 0x1a,
@@ -400,3 +504,213 @@ func TestDecodeConfig(t *testing.T) {
 		return
 	}
 }
+
+func TestDecodeAllParallel(t *testing.T) {
+	inputs := map[string][]byte{}
+	for _, name := range []string{"WithDefaultFrame.png", "WithoutDefaultFrame.png", "MultipleIDATs.png"} {
+		b, err := os.ReadFile("tests/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[name] = b
+	}
+	a := movingSquare(6, func(r image.Rectangle) image.Image { return image.NewNRGBA64(r) })
+	for name, enc := range map[string]*Encoder{
+		"small chunks": {ChunkSize: 100},
+		"interlaced":   {Interlaced: true, ChunkSize: 500},
+		"keyframes":    {KeyframeInterval: KeyframeInterval{Frames: 2}},
+	} {
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+		inputs[name] = buf.Bytes()
+	}
+
+	for name, in := range inputs {
+		want, err := DecodeAll(bytes.NewReader(in))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, workers := range []int{0, 1, 3} {
+			got, err := DecodeAllParallel(bytes.NewReader(in), int64(len(in)), workers)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(got.Frames) != len(want.Frames) || got.LoopCount != want.LoopCount ||
+				fmt.Sprint(got.Keyframes) != fmt.Sprint(want.Keyframes) {
+				t.Fatalf("%s: got %d frames, loop count %d, keyframes %v, want %d, %d, %v", name,
+					len(got.Frames), got.LoopCount, got.Keyframes, len(want.Frames), want.LoopCount, want.Keyframes)
+			}
+			for i := range want.Frames {
+				fw, fg := want.Frames[i], got.Frames[i]
+				imgw, imgg := fw.Image, fg.Image
+				fw.Image, fg.Image = nil, nil
+				if fw != fg {
+					t.Errorf("%s: frame %d: got %+v, want %+v", name, i, fg, fw)
+				}
+				if fmt.Sprintf("%T", imgw) != fmt.Sprintf("%T", imgg) {
+					t.Errorf("%s: frame %d: got %T, want %T", name, i, imgg, imgw)
+				} else if err := diff(imgw, imgg); err != nil {
+					t.Errorf("%s: frame %d: %v", name, i, err)
+				}
+			}
+		}
+
+		// Damaged image data must be reported, as by DecodeAll.
+		bad := append([]byte(nil), in...)
+		bad[len(bad)-20] ^= 0xff
+		if _, err := DecodeAllParallel(bytes.NewReader(bad), int64(len(bad)), 2); err == nil {
+			t.Errorf("%s: no error for damaged input", name)
+		}
+	}
+}
+
+type decoderPool struct {
+	b *DecoderBuffer
+}
+
+func (p *decoderPool) Get() *DecoderBuffer {
+	return p.b
+}
+
+func (p *decoderPool) Put(b *DecoderBuffer) {
+	p.b = b
+}
+
+func TestDecodeInto(t *testing.T) {
+	for _, interlaced := range []bool{false, true} {
+		a := movingSquare(6, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+		var buf bytes.Buffer
+		if err := (&Encoder{Interlaced: interlaced}).Encode(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+		in := buf.Bytes()
+
+		dec := &Decoder{BufferPool: &decoderPool{}}
+		var got APNG
+		if err := dec.DecodeInto(bytes.NewReader(in), &got); err != nil {
+			t.Fatal(err)
+		}
+		images := make([]image.Image, len(got.Frames))
+		for i, f := range got.Frames {
+			images[i] = f.Image
+			// Scribble over the image, which must be fully overwritten.
+			pix := f.Image.(*image.NRGBA).Pix
+			for j := range pix {
+				pix[j] = 0x5a
+			}
+		}
+		if err := dec.DecodeInto(bytes.NewReader(in), &got); err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range got.Frames {
+			if f.Image != images[i] {
+				t.Errorf("interlaced %v: frame %d: image was not reused", interlaced, i)
+			}
+			if err := diff(a.Frames[i].Image, f.Image); err != nil {
+				t.Errorf("interlaced %v: frame %d: %v", interlaced, i, err)
+			}
+		}
+
+		r := bytes.NewReader(in)
+		allocs := testing.AllocsPerRun(10, func() {
+			r.Reset(in)
+			if err := dec.DecodeInto(r, &got); err != nil {
+				t.Fatal(err)
+			}
+		})
+		// Resetting a compress/zlib reader allocates a new checksum, but
+		// nothing else should be allocated.
+		if allocs > float64(len(got.Frames)) {
+			t.Errorf("interlaced %v: got %v allocations per decode, want at most %d", interlaced, allocs, len(got.Frames))
+		}
+	}
+}
+
+// countingReader counts the bytes of decompressed image data read through it.
+type countingReader struct {
+	io.ReadCloser
+	n *int
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.n += n
+	return n, err
+}
+
+func TestDecompressionReader(t *testing.T) {
+	a := movingSquare(4, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	var buf bytes.Buffer
+	if err := Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	in := buf.Bytes()
+
+	var calls, n int
+	dec := &Decoder{
+		BufferPool: &decoderPool{},
+		DecompressionReader: func(r io.Reader) (io.ReadCloser, error) {
+			calls++
+			zr, err := zlib.NewReader(r)
+			return countingReader{zr, &n}, err
+		},
+	}
+	b, err := dec.DecodeAll(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range b.Frames {
+		if err := diff(a.Frames[i].Image, f.Image); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+	// countingReader doesn't implement zlib.Resetter, so each frame has its
+	// own reader. Each row has a filter type byte.
+	if calls != len(a.Frames) {
+		t.Errorf("DecompressionReader called %d times, want %d", calls, len(a.Frames))
+	}
+	if want := len(a.Frames) * 48 * (1 + 64*3); n != want {
+		t.Errorf("read %d bytes, want %d", n, want)
+	}
+
+	// Decoding with the default reader again must not reuse the custom one.
+	n = 0
+	dec.DecompressionReader = nil
+	if _, err := dec.DecodeAll(bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("custom reader was reused, read %d bytes", n)
+	}
+
+	// A reader from one DecompressionReader that can be reset must not be
+	// reused by a Decoder with another.
+	var callsA, callsB int
+	dec.DecompressionReader = func(r io.Reader) (io.ReadCloser, error) {
+		callsA++
+		return zlib.NewReader(r)
+	}
+	if _, err := dec.DecodeAll(bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	dec.DecompressionReader = func(r io.Reader) (io.ReadCloser, error) {
+		callsB++
+		return zlib.NewReader(r)
+	}
+	if _, err := dec.DecodeAll(bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if callsA != 1 || callsB != 1 {
+		t.Errorf("DecompressionReaders called %d and %d times, want 1 each", callsA, callsB)
+	}
+
+	errLimit := errors.New("limit exceeded")
+	dec.DecompressionReader = func(r io.Reader) (io.ReadCloser, error) {
+		return nil, errLimit
+	}
+	if _, err := dec.DecodeAll(bytes.NewReader(in)); err != errLimit {
+		t.Errorf("got error %v, want %v", err, errLimit)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ResampleMode selects how Resample chooses the image of each output frame.
+type ResampleMode int
+
+const (
+	// ResampleNearest shows the source frame that is shown at the start of
+	// each output frame.
+	ResampleNearest ResampleMode = iota
+	// ResampleBlend blends the source frames that are shown during each
+	// output frame, weighted by how long each is shown.
+	ResampleBlend
+)
+
+// timeline holds the canvas after each frame of an animation, and when each
+// frame starts, for picking frames by time.
+type timeline struct {
+	canvases []*image.NRGBA64
+	// starts holds the start of each frame, and then the end of the last.
+	starts []time.Duration
+}
+
+func newTimeline(a APNG) timeline {
+	frames := animationFrames(a)
+	tl := timeline{canvases: canvases(a), starts: make([]time.Duration, len(frames)+1)}
+	for i := range frames {
+		tl.starts[i+1] = tl.starts[i] + frames[i].Duration()
+	}
+	return tl
+}
+
+// total returns how long one play of the animation takes.
+func (tl timeline) total() time.Duration {
+	return tl.starts[len(tl.starts)-1]
+}
+
+// at returns the index of the frame shown at time t of the first play. The
+// last frame stays shown after the end.
+func (tl timeline) at(t time.Duration) int {
+	return sort.Search(len(tl.canvases)-1, func(i int) bool { return tl.starts[i+1] > t })
+}
+
+// Resample returns a copy of a whose frames cover the whole canvas and are
+// all shown for 1/fps of a second, for video encoders and engines that need
+// a constant frame rate. The number of frames is the total duration of a
+// times fps, rounded, and at least 1. The frame interval is the closest
+// fraction of a second that fits in a frame's delay, and output frame k
+// starts at k times that interval. The mode selects the image of each frame.
+// The images are of the smallest type that suits a's first frame, as with
+// the Encoder's DeltaFrames. A default image and the LoopCount are kept.
+func Resample(a APNG, fps float64, mode ResampleMode) (APNG, error) {
+	if len(animationFrames(a)) == 0 {
+		return a, nil
+	}
+	if fps <= 0 || math.IsInf(fps, 0) || math.IsNaN(fps) {
+		return a, FormatError("invalid frame rate: " + strconv.FormatFloat(fps, 'g', -1, 64))
+	}
+	num, den, ok := delayFraction(new(big.Rat).Inv(new(big.Rat).SetFloat64(fps)))
+	if !ok || num == 0 {
+		return a, UnsupportedError("frame rate does not fit in a frame delay: " + strconv.FormatFloat(fps, 'g', -1, 64))
+	}
+	interval := Frame{DelayNumerator: num, DelayDenominator: den}
+
+	tl := newTimeline(a)
+	n := int((tl.total() + interval.Duration()/2) / interval.Duration())
+	if n < 1 {
+		n = 1
+	}
+	// start returns the start of output frame k, exactly, rounded to the
+	// nanosecond.
+	start := func(k int) time.Duration {
+		q := uint64(k) * uint64(num)
+		secs, rem := q/uint64(den), q%uint64(den)
+		return time.Duration(secs)*time.Second + time.Duration((rem*uint64(time.Second)+uint64(den)/2)/uint64(den))
+	}
+
+	frames := make([]Frame, n)
+	// used holds the canvases already given to a frame. A canvas shown for
+	// several frames is copied, as 16-bit frames keep their images and
+	// mustn't share them.
+	used := make(map[*image.NRGBA64]bool)
+	for k := range frames {
+		t0, t1 := start(k), start(k+1)
+		var m *image.NRGBA64
+		if mode == ResampleBlend {
+			m = tl.blend(t0, t1)
+		} else {
+			m = tl.canvases[tl.at(t0)]
+		}
+		if used[m] {
+			m = cloneNRGBA64(m)
+		}
+		used[m] = true
+		frames[k] = Frame{Image: m, DelayNumerator: num, DelayDenominator: den}
+	}
+	return withFrames(a, frames), nil
+}
+
+// blend returns the average of the canvases shown from t0 to t1, weighted by
+// how long each is shown. The colors are averaged with their alpha
+// premultiplied, so that transparent pixels don't darken the result.
+func (tl timeline) blend(t0, t1 time.Duration) *image.NRGBA64 {
+	first, last := tl.at(t0), tl.at(t1-1)
+	if t1 > tl.total() {
+		// The last frame stays shown after the end.
+		last = len(tl.canvases) - 1
+	}
+	if first == last {
+		return tl.canvases[first]
+	}
+	m := image.NewNRGBA64(tl.canvases[first].Rect)
+	sums := make([]float64, len(m.Pix)/2)
+	var total float64
+	for i := first; i <= last; i++ {
+		s, e := tl.starts[i], tl.starts[i+1]
+		if i == len(tl.canvases)-1 {
+			e = t1
+		}
+		if s < t0 {
+			s = t0
+		}
+		if e > t1 {
+			e = t1
+		}
+		w := float64(e - s)
+		if w <= 0 {
+			continue
+		}
+		total += w
+		pix := tl.canvases[i].Pix
+		for j := 0; j < len(pix); j += 8 {
+			a := w * float64(uint16(pix[j+6])<<8|uint16(pix[j+7]))
+			sums[j/2+0] += a * float64(uint16(pix[j+0])<<8|uint16(pix[j+1]))
+			sums[j/2+1] += a * float64(uint16(pix[j+2])<<8|uint16(pix[j+3]))
+			sums[j/2+2] += a * float64(uint16(pix[j+4])<<8|uint16(pix[j+5]))
+			sums[j/2+3] += a
+		}
+	}
+	for j := 0; j < len(m.Pix); j += 8 {
+		a := sums[j/2+3]
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			v := uint16(sums[j/2+c]/a + 0.5)
+			m.Pix[j+2*c], m.Pix[j+2*c+1] = uint8(v>>8), uint8(v)
+		}
+		v := uint16(a/total + 0.5)
+		m.Pix[j+6], m.Pix[j+7] = uint8(v>>8), uint8(v)
+	}
+	return m
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// solidFrame returns a frame of a solid 4x4 image of c with the given delay
+// in milliseconds.
+func solidFrame(c color.NRGBA, ms uint16) Frame {
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return Frame{Image: m, DelayNumerator: ms, DelayDenominator: 1000}
+}
+
+// checkUnshared checks that no two frames of a share their pixels, so that
+// changing one frame doesn't change another.
+func checkUnshared(t *testing.T, name string, a APNG) {
+	t.Helper()
+	seen := make(map[*uint8]int)
+	for i, f := range a.Frames {
+		p, ok := pixBuffer(f.Image)
+		if !ok || len(p.pix) == 0 {
+			continue
+		}
+		if j, ok := seen[&p.pix[0]]; ok {
+			t.Errorf("%s: frames %d and %d share their pixels", name, j, i)
+		}
+		seen[&p.pix[0]] = i
+	}
+}
+
+func TestResample(t *testing.T) {
+	red, green, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0xff, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+	a := APNG{LoopCount: 3, Frames: []Frame{
+		solidFrame(red, 10),
+		solidFrame(green, 30),
+		solidFrame(blue, 20),
+	}}
+
+	tests := []struct {
+		fps    float64
+		mode   ResampleMode
+		colors []color.NRGBA
+	}{
+		{100, ResampleNearest, []color.NRGBA{red, green, green, green, blue, blue}},
+		{50, ResampleNearest, []color.NRGBA{red, green, blue}},
+		// Each 20ms frame blends what was shown during it.
+		{50, ResampleBlend, []color.NRGBA{{0x80, 0x80, 0, 0xff}, green, blue}},
+		// The last frame stays shown past the end.
+		{25, ResampleBlend, []color.NRGBA{{0x40, 0xbf, 0, 0xff}, blue}},
+	}
+	for _, test := range tests {
+		b, err := Resample(a, test.fps, test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.LoopCount != a.LoopCount {
+			t.Errorf("%v fps: LoopCount %d, want %d", test.fps, b.LoopCount, a.LoopCount)
+		}
+		if len(b.Frames) != len(test.colors) {
+			t.Fatalf("%v fps, mode %d: got %d frames, want %d", test.fps, test.mode, len(b.Frames), len(test.colors))
+		}
+		for i, f := range b.Frames {
+			if f.DelayNumerator != 1 || f.DelayDenominator != uint16(test.fps) {
+				t.Errorf("%v fps: frame %d: delay %d/%d", test.fps, i, f.DelayNumerator, f.DelayDenominator)
+			}
+			if err := diff(solidFrame(test.colors[i], 0).Image, f.Image); err != nil {
+				t.Errorf("%v fps, mode %d: frame %d: %v", test.fps, test.mode, i, err)
+			}
+		}
+	}
+
+	// 16-bit frames are kept as they are, so a canvas shown for several
+	// frames must be copied.
+	deep := APNG{Frames: make([]Frame, len(a.Frames))}
+	for i, f := range a.Frames {
+		f.Image = toNRGBA64(f.Image)
+		deep.Frames[i] = f
+	}
+	for _, mode := range []ResampleMode{ResampleNearest, ResampleBlend} {
+		b, err := Resample(deep, 100, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUnshared(t, "16-bit", b)
+	}
+
+	b, err := Resample(a, 29.97, ResampleNearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := b.Frames[0]; f.DelayNumerator != 100 || f.DelayDenominator != 2997 {
+		t.Errorf("29.97 fps: delay %d/%d, want 100/2997", f.DelayNumerator, f.DelayDenominator)
+	}
+	for _, fps := range []float64{0, -1, 1e9} {
+		if _, err := Resample(a, fps, ResampleNearest); err == nil {
+			t.Errorf("%v fps: no error", fps)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"math"
+	"strconv"
+)
+
+// ResizeFilter selects how Resize computes each pixel from the pixels
+// around it.
+type ResizeFilter int
+
+const (
+	// ResizeNearest uses the closest pixel, keeping the colors and hard
+	// edges of pixel art.
+	ResizeNearest ResizeFilter = iota
+	// ResizeBilinear interpolates linearly between the 2x2 closest pixels,
+	// or averages the pixels covered when shrinking.
+	ResizeBilinear
+	// ResizeLanczos uses a 3-lobed Lanczos filter, which is the sharpest but
+	// may ring around hard edges.
+	ResizeLanczos
+)
+
+// Resize returns a copy of a scaled to width by height pixels. Each frame
+// after the first covers only the region of the canvas it changes, as
+// scaled, so that delta frames stay small. The region is expanded to cover
+// every pixel that the filter computes from the changed pixels, so that
+// there are no seams where rounding or the filter's reach would otherwise
+// leave pixels of the previous frame. Those frames are written with
+// DISPOSE_OP_NONE and BLEND_OP_SOURCE. The images are of the smallest type
+// that suits a's first frame, as with the Encoder's DeltaFrames, so
+// ResizeNearest keeps paletted frames paletted. The default image, if any,
+// is scaled too. If a already has that size, it is returned unchanged.
+func Resize(a APNG, width, height int, filter ResizeFilter) (APNG, error) {
+	if width <= 0 || height <= 0 {
+		return a, FormatError("invalid size: " + strconv.Itoa(width) + "x" + strconv.Itoa(height))
+	}
+	if filter < ResizeNearest || filter > ResizeLanczos {
+		return a, UnsupportedError("resize filter " + strconv.Itoa(int(filter)))
+	}
+	if len(a.Frames) == 0 {
+		return a, nil
+	}
+	b := a.Frames[0].Image.Bounds()
+	if b.Dx() == width && b.Dy() == height {
+		return a, nil
+	}
+	rs := resizer{
+		filter: filter,
+		x:      newAxisWeights(b.Dx(), width, filter),
+		y:      newAxisWeights(b.Dy(), height, filter),
+	}
+	dst := image.Rect(0, 0, width, height)
+	out := APNG{LoopCount: a.LoopCount, Keyframes: append([]int(nil), a.Keyframes...)}
+	c := newCompositor(b.Dx(), b.Dy())
+	first := true
+	for _, f := range a.Frames {
+		if f.IsDefault {
+			f.Image = rs.resize(toNRGBA64(f.Image), dst)
+			out.Frames = append(out.Frames, f)
+			continue
+		}
+		// The canvas changes where the frame is drawn, and where the frame
+		// before it is disposed of.
+		changed := c.frameRect(f)
+		if c.disposeOp != DISPOSE_OP_NONE {
+			changed = changed.Union(c.last)
+		}
+		c.draw(f)
+		r := dst
+		if !first {
+			r = rs.rect(changed)
+			if r.Empty() {
+				// Nothing changed, but a frame can't be empty.
+				r = image.Rect(0, 0, 1, 1)
+			}
+		}
+		first = false
+		out.Frames = append(out.Frames, Frame{
+			Image:            rs.resize(c.canvas, r),
+			XOffset:          r.Min.X,
+			YOffset:          r.Min.Y,
+			DelayNumerator:   f.DelayNumerator,
+			DelayDenominator: f.DelayDenominator,
+		})
+	}
+	convertDeltaFrames(out.Frames, animationFrames(a)[0].Image)
+	return out, nil
+}
+
+// axisWeights holds, for each pixel along one axis of the resized image, the
+// first source pixel it is computed from and the weights of the source
+// pixels from there on.
+type axisWeights struct {
+	start   []int
+	weights [][]float32
+}
+
+// newAxisWeights returns the weights for resizing n pixels to m pixels with
+// filter.
+func newAxisWeights(n, m int, filter ResizeFilter) axisWeights {
+	aw := axisWeights{start: make([]int, m), weights: make([][]float32, m)}
+	if filter == ResizeNearest {
+		one := []float32{1}
+		for x := range aw.start {
+			aw.start[x] = (2*x + 1) * n / (2 * m)
+			aw.weights[x] = one
+		}
+		return aw
+	}
+	kernel, radius := bilinearKernel, 1.0
+	if filter == ResizeLanczos {
+		kernel, radius = lanczosKernel, 3.0
+	}
+	// When shrinking, the kernel is stretched to cover every source pixel.
+	scale := float64(m) / float64(n)
+	ks := 1.0
+	if scale < 1 {
+		ks = scale
+		radius /= scale
+	}
+	for x := range aw.start {
+		center := (float64(x)+0.5)/scale - 0.5
+		// Pixels at exactly the radius have no weight.
+		lo := int(math.Floor(center-radius)) + 1
+		hi := int(math.Ceil(center+radius)) - 1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > n-1 {
+			hi = n - 1
+		}
+		w := make([]float64, hi-lo+1)
+		var sum float64
+		for i := range w {
+			w[i] = kernel((float64(lo+i) - center) * ks)
+			sum += w[i]
+		}
+		aw.start[x] = lo
+		aw.weights[x] = make([]float32, len(w))
+		for i := range w {
+			aw.weights[x][i] = float32(w[i] / sum)
+		}
+	}
+	return aw
+}
+
+// bilinearKernel is the triangle filter, which interpolates linearly.
+func bilinearKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x >= 1 {
+		return 0
+	}
+	return 1 - x
+}
+
+// lanczosKernel is the Lanczos filter with 3 lobes.
+func lanczosKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x >= 3 {
+		return 0
+	}
+	if x < 1e-9 {
+		return 1
+	}
+	px := math.Pi * x
+	return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// span returns the pixels of the resized axis that are computed from any of
+// the source pixels from a to b.
+func (aw axisWeights) span(a, b int) (int, int) {
+	lo, hi := len(aw.start), 0
+	for x, s := range aw.start {
+		if s < b && s+len(aw.weights[x]) > a {
+			if x < lo {
+				lo = x
+			}
+			hi = x + 1
+		}
+	}
+	return lo, hi
+}
+
+// resizer resizes canvases, or regions of them, with the weights of each
+// axis.
+type resizer struct {
+	filter ResizeFilter
+	x, y   axisWeights
+	row    []float32 // A premultiplied source row.
+	tmp    []float32 // The source rows resized horizontally.
+}
+
+// rect returns the region of the resized canvas that is computed from any
+// of the pixels of r.
+func (rs *resizer) rect(r image.Rectangle) image.Rectangle {
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+	x0, x1 := rs.x.span(r.Min.X, r.Max.X)
+	y0, y1 := rs.y.span(r.Min.Y, r.Max.Y)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// resize returns the pixels of r of src resized, as an image with its origin
+// at (0, 0). Colors are filtered with their alpha premultiplied, so that
+// transparent pixels don't darken the edges around them.
+func (rs *resizer) resize(src *image.NRGBA64, r image.Rectangle) *image.NRGBA64 {
+	m := image.NewNRGBA64(image.Rect(0, 0, r.Dx(), r.Dy()))
+	xs := rs.x.start[r.Min.X]
+	xe := rs.x.start[r.Max.X-1] + len(rs.x.weights[r.Max.X-1])
+	ys := rs.y.start[r.Min.Y]
+	ye := rs.y.start[r.Max.Y-1] + len(rs.y.weights[r.Max.Y-1])
+
+	if rs.filter == ResizeNearest {
+		// Nearest neighbor copies pixels as they are.
+		for y := 0; y < r.Dy(); y++ {
+			sy := rs.y.start[r.Min.Y+y]
+			for x := 0; x < r.Dx(); x++ {
+				i := src.PixOffset(rs.x.start[r.Min.X+x], sy)
+				copy(m.Pix[m.PixOffset(x, y):], src.Pix[i:i+8])
+			}
+		}
+		return m
+	}
+
+	// Resize the source rows horizontally.
+	w := r.Dx() * 4
+	rs.tmp = growFloats(rs.tmp, (ye-ys)*w)
+	rs.row = growFloats(rs.row, (xe-xs)*4)
+	for y := ys; y < ye; y++ {
+		pix := src.Pix[src.PixOffset(xs, y):]
+		for i := 0; i < len(rs.row); i += 4 {
+			p := pix[2*i : 2*i+8]
+			a := float32(uint16(p[6])<<8|uint16(p[7])) / 0xffff
+			for c := 0; c < 3; c++ {
+				rs.row[i+c] = float32(uint16(p[2*c])<<8|uint16(p[2*c+1])) / 0xffff * a
+			}
+			rs.row[i+3] = a
+		}
+		t := rs.tmp[(y-ys)*w : (y-ys+1)*w]
+		for x := 0; x < r.Dx(); x++ {
+			var sum [4]float32
+			s := (rs.x.start[r.Min.X+x] - xs) * 4
+			for k, wt := range rs.x.weights[r.Min.X+x] {
+				p := rs.row[s+4*k : s+4*k+4]
+				sum[0] += wt * p[0]
+				sum[1] += wt * p[1]
+				sum[2] += wt * p[2]
+				sum[3] += wt * p[3]
+			}
+			copy(t[4*x:], sum[:])
+		}
+	}
+
+	// Then resize them vertically.
+	for y := 0; y < r.Dy(); y++ {
+		s := rs.y.start[r.Min.Y+y] - ys
+		weights := rs.y.weights[r.Min.Y+y]
+		for x := 0; x < r.Dx(); x++ {
+			var sum [4]float32
+			for k, wt := range weights {
+				p := rs.tmp[(s+k)*w+4*x:]
+				sum[0] += wt * p[0]
+				sum[1] += wt * p[1]
+				sum[2] += wt * p[2]
+				sum[3] += wt * p[3]
+			}
+			a := clampUnit(sum[3])
+			if a == 0 {
+				continue
+			}
+			i := m.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				v := uint16(clampUnit(sum[c]/a)*0xffff + 0.5)
+				m.Pix[i+2*c], m.Pix[i+2*c+1] = uint8(v>>8), uint8(v)
+			}
+			v := uint16(a*0xffff + 0.5)
+			m.Pix[i+6], m.Pix[i+7] = uint8(v>>8), uint8(v)
+		}
+	}
+	return m
+}
+
+// clampUnit clamps v to [0, 1], as filters with negative weights can
+// overshoot.
+func clampUnit(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// growFloats returns b resized to n, reusing its memory if it can.
+func growFloats(b []float32, n int) []float32 {
+	if cap(b) < n {
+		return make([]float32, n)
+	}
+	return b[:n]
+}
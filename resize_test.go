@@ -0,0 +1,103 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	a := deltaSquare(t, 6)
+	sizes := []image.Point{{128, 96}, {37, 29}, {100, 30}}
+	for _, filter := range []ResizeFilter{ResizeNearest, ResizeBilinear, ResizeLanczos} {
+		for _, size := range sizes {
+			b, err := Resize(a, size.X, size.Y, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every canvas must be the same as resizing the whole canvas of
+			// the original, with no seams around the resized delta frames.
+			rs := resizer{
+				filter: filter,
+				x:      newAxisWeights(64, size.X, filter),
+				y:      newAxisWeights(48, size.Y, filter),
+			}
+			dst := image.Rect(0, 0, size.X, size.Y)
+			want, got := composite(a), composite(b)
+			if len(got) != len(want) {
+				t.Fatalf("filter %d, %v: got %d frames, want %d", filter, size, len(got), len(want))
+			}
+			small := false
+			for i := range want {
+				// The canvases of b went through 8 bits, as a's frames are
+				// 8-bit.
+				full := []Frame{{Image: rs.resize(want[i], dst)}}
+				convertDeltaFrames(full, a.Frames[0].Image)
+				if err := diff(composite(APNG{Frames: full})[0], got[i]); err != nil {
+					t.Errorf("filter %d, %v: frame %d: %v", filter, size, i, err)
+				}
+				if i > 0 && b.Frames[i].Image.Bounds().Dx() < size.X {
+					small = true
+				}
+			}
+			if !small {
+				t.Errorf("filter %d, %v: every frame covers the whole canvas", filter, size)
+			}
+		}
+	}
+}
+
+func TestResizeNearestPaletted(t *testing.T) {
+	pal := color.Palette{color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{0xff, 0, 0, 0xff}}
+	a := movingSquare(3, func(r image.Rectangle) image.Image {
+		return image.NewPaletted(r, pal)
+	})
+	b, err := Resize(a, 96, 72, ResizeNearest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range b.Frames {
+		m, ok := f.Image.(*image.Paletted)
+		if !ok {
+			t.Fatalf("frame %d: got %T, want *image.Paletted", i, f.Image)
+		}
+		for y := 0; y < m.Rect.Dy(); y++ {
+			for x := 0; x < m.Rect.Dx(); x++ {
+				// The source pixel whose center is closest.
+				sx, sy := (2*(f.XOffset+x)+1)/3, (2*(f.YOffset+y)+1)/3
+				if m.At(x, y) != a.Frames[i].Image.At(sx, sy) {
+					t.Fatalf("frame %d: pixel (%d, %d) is not from (%d, %d)", i, x, y, sx, sy)
+				}
+			}
+		}
+	}
+
+	if _, err := Resize(a, 0, 10, ResizeNearest); err == nil {
+		t.Error("no error for an empty size")
+	}
+}
+
+func TestResizeUniform(t *testing.T) {
+	// Filtering a single color, even with negative weights, must keep it.
+	m := image.NewNRGBA(image.Rect(0, 0, 13, 7))
+	for i := 0; i < len(m.Pix); i += 4 {
+		copy(m.Pix[i:], []uint8{0x40, 0x80, 0xc0, 0x80})
+	}
+	a := APNG{Frames: []Frame{{Image: m}}}
+	for _, filter := range []ResizeFilter{ResizeBilinear, ResizeLanczos} {
+		b, err := Resize(a, 31, 5, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := b.Frames[0].Image.(*image.NRGBA)
+		for i := 0; i < len(n.Pix); i += 4 {
+			if c := n.Pix[i : i+4]; c[0] != 0x40 || c[1] != 0x80 || c[2] != 0xc0 || c[3] != 0x80 {
+				t.Fatalf("filter %d: got %v", filter, c)
+			}
+		}
+	}
+}
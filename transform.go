@@ -0,0 +1,235 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// animationFrames returns the frames of a's animation, without a default
+// image.
+func animationFrames(a APNG) []Frame {
+	if len(a.Frames) > 0 && a.Frames[0].IsDefault {
+		return a.Frames[1:]
+	}
+	return a.Frames
+}
+
+// withFrames returns an APNG with the LoopCount and default image of a and
+// the given frames, whose images must be *image.NRGBA64. The images are
+// converted to the smallest type that suits the first frame of a, as with
+// the Encoder's DeltaFrames.
+func withFrames(a APNG, frames []Frame) APNG {
+	out := APNG{LoopCount: a.LoopCount}
+	if a.Frames[0].IsDefault {
+		def := a.Frames[0]
+		def.Image = toNRGBA64(def.Image)
+		out.Frames = append(out.Frames, def)
+	}
+	out.Frames = append(out.Frames, frames...)
+	convertDeltaFrames(out.Frames, animationFrames(a)[0].Image)
+	return out
+}
+
+// canvasFrames returns full-canvas frames showing the canvas after each frame
+// of a's animation, with the same delays.
+func canvasFrames(a APNG) []Frame {
+	frames := animationFrames(a)
+	out := make([]Frame, len(frames))
+	for i, m := range canvases(a) {
+		out[i] = Frame{Image: m, DelayNumerator: frames[i].DelayNumerator, DelayDenominator: frames[i].DelayDenominator}
+	}
+	return out
+}
+
+// Reverse returns a copy of a that plays backwards. As frames may depend on
+// the frames before them, the frames are composited first, and the result
+// has full-canvas frames, as with Resample.
+func Reverse(a APNG) APNG {
+	frames := canvasFrames(a)
+	if len(frames) == 0 {
+		return a
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return withFrames(a, frames)
+}
+
+// PingPong returns a copy of a that plays forwards and then backwards. The
+// first and last frames are not repeated when it turns around, so that it
+// loops smoothly. The result has full-canvas frames, as with Reverse.
+func PingPong(a APNG) APNG {
+	frames := canvasFrames(a)
+	if len(frames) == 0 {
+		return a
+	}
+	for i := len(frames) - 2; i > 0; i-- {
+		// 16-bit frames keep their images, so repeated frames get a copy.
+		f := frames[i]
+		f.Image = cloneNRGBA64(f.Image.(*image.NRGBA64))
+		frames = append(frames, f)
+	}
+	return withFrames(a, frames)
+}
+
+// Trim returns a copy of a that only plays what is shown from start to end
+// of its first play. Frames that are partly shown in that time have their
+// delays shortened, and frames that aren't shown are dropped. The result has
+// full-canvas frames, as with Reverse. It returns an error if nothing is
+// shown from start to end.
+func Trim(a APNG, start, end time.Duration) (APNG, error) {
+	frames := canvasFrames(a)
+	var out []Frame
+	var t time.Duration
+	for _, f := range frames {
+		s, e := t, t+f.Duration()
+		t = e
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		if e <= s {
+			continue
+		}
+		f.SetDuration(e - s)
+		out = append(out, f)
+	}
+	if len(out) == 0 {
+		return a, FormatError("nothing is shown from " + start.String() + " to " + end.String())
+	}
+	return withFrames(a, out), nil
+}
+
+// Unroll returns a copy of a that plays the animation n times in one play,
+// such as for players that ignore LoopCount. The LoopCount is divided by n,
+// rounded up, so the animation plays at least as many times as before. The
+// result has full-canvas frames, as with Reverse.
+func Unroll(a APNG, n int) APNG {
+	frames := canvasFrames(a)
+	if len(frames) == 0 || n < 2 {
+		return a
+	}
+	play := frames
+	for i := 1; i < n; i++ {
+		// 16-bit frames keep their images, so repeated frames get a copy.
+		for _, f := range play {
+			f.Image = cloneNRGBA64(f.Image.(*image.NRGBA64))
+			frames = append(frames, f)
+		}
+	}
+	out := withFrames(a, frames)
+	out.LoopCount = (a.LoopCount + uint(n) - 1) / uint(n)
+	return out
+}
+
+// Speed returns a copy of a that plays factor times as fast, with each delay
+// divided by factor. The delays are the closest fractions that fit in a
+// frame's delay, up to 65535 seconds. The frames are not composited, and
+// share their images with a.
+func Speed(a APNG, factor float64) (APNG, error) {
+	if factor <= 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+		return a, FormatError("invalid speed factor: " + strconv.FormatFloat(factor, 'g', -1, 64))
+	}
+	r := new(big.Rat).SetFloat64(factor)
+	out := a
+	out.Frames = append([]Frame(nil), a.Frames...)
+	out.Keyframes = append([]int(nil), a.Keyframes...)
+	for i := range out.Frames {
+		f := &out.Frames[i]
+		if f.IsDefault {
+			continue
+		}
+		num, den, ok := delayFraction(new(big.Rat).Quo(f.delayRat(), r))
+		if !ok {
+			num, den = 0xffff, 1
+		}
+		f.DelayNumerator, f.DelayDenominator = num, den
+	}
+	return out, nil
+}
+
+// Decimate returns a copy of a with at most maxFrames frames, and at most
+// fps frames per second on average over one play, for platforms that limit
+// either. A limit of 0 means no limit. The frames kept are those shown at
+// evenly spaced times, and each dropped frame's delay is added to the kept
+// frame shown in its place. Delays that don't fit a fraction of two 16-bit
+// integers are rounded, carrying the error into the next frame's delay, so
+// the total duration only differs by the rounding of the last. As frames
+// may depend on the frames before them, the frames are composited first,
+// and the result has full-canvas frames, as with Reverse. If a is within
+// both limits, it is returned unchanged.
+func Decimate(a APNG, maxFrames int, fps float64) (APNG, error) {
+	if maxFrames < 0 {
+		return a, FormatError("invalid frame count: " + strconv.Itoa(maxFrames))
+	}
+	if fps < 0 || math.IsInf(fps, 0) || math.IsNaN(fps) {
+		return a, FormatError("invalid frame rate: " + strconv.FormatFloat(fps, 'g', -1, 64))
+	}
+	frames := animationFrames(a)
+	var total time.Duration
+	for _, f := range frames {
+		total += f.Duration()
+	}
+	n := len(frames)
+	if maxFrames > 0 && maxFrames < n {
+		n = maxFrames
+	}
+	if fps > 0 {
+		m := int(total.Seconds() * fps)
+		if m < 1 {
+			m = 1
+		}
+		if m < n {
+			n = m
+		}
+	}
+	if n >= len(frames) {
+		return a, nil
+	}
+
+	tl := newTimeline(a)
+	var kept []int
+	for k := 0; k < n; k++ {
+		i := tl.at(time.Duration(float64(total) * float64(k) / float64(n)))
+		if len(kept) == 0 || kept[len(kept)-1] != i {
+			kept = append(kept, i)
+		}
+	}
+	// Each kept frame is shown until the exact time the next one starts, less
+	// the delays already written, so that the rounding of one delay is made
+	// up by the next instead of adding up.
+	out := make([]Frame, len(kept))
+	end, shown := new(big.Rat), new(big.Rat)
+	next := 0
+	for j, i := range kept {
+		last := len(frames)
+		if j+1 < len(kept) {
+			last = kept[j+1]
+		}
+		// Frames before the first one kept are shown for no time at all.
+		for ; next < last; next++ {
+			end.Add(end, frames[next].delayRat())
+		}
+		delay := new(big.Rat).Sub(end, shown)
+		if delay.Sign() < 0 {
+			delay.SetInt64(0)
+		}
+		num, den, ok := delayFraction(delay)
+		if !ok {
+			num, den = 0xffff, 1
+		}
+		f := Frame{Image: tl.canvases[i], DelayNumerator: num, DelayDenominator: den}
+		shown.Add(shown, f.delayRat())
+		out[j] = f
+	}
+	return withFrames(a, out), nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// deltaSquare returns movingSquare(n) as decoded after delta encoding, so
+// that its frames depend on the frames before them.
+func deltaSquare(t *testing.T, n int) APNG {
+	a := movingSquare(n, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	var buf bytes.Buffer
+	if err := (&Encoder{DeltaFrames: true}).Encode(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// checkFrames checks that the frames of b show the canvases of a with the
+// given indices, and have the given delays.
+func checkFrames(t *testing.T, name string, a, b APNG, indices []int, delays []time.Duration) {
+	t.Helper()
+	want, got := composite(a), composite(b)
+	if len(got) != len(indices) {
+		t.Fatalf("%s: got %d frames, want %d", name, len(got), len(indices))
+	}
+	for i, j := range indices {
+		if err := diff(want[j], got[i]); err != nil {
+			t.Errorf("%s: frame %d: %v", name, i, err)
+		}
+		if d := b.Frames[i].Duration(); d != delays[i] {
+			t.Errorf("%s: frame %d: delay %v, want %v", name, i, d, delays[i])
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	// The delays are 10ms, 20ms, 30ms and 40ms.
+	a := deltaSquare(t, 4)
+	a.LoopCount = 3
+
+	checkFrames(t, "Reverse", a, Reverse(a), []int{3, 2, 1, 0}, ms(40, 30, 20, 10))
+	checkFrames(t, "PingPong", a, PingPong(a), []int{0, 1, 2, 3, 2, 1}, ms(10, 20, 30, 40, 30, 20))
+
+	b := Unroll(a, 2)
+	checkFrames(t, "Unroll", a, b, []int{0, 1, 2, 3, 0, 1, 2, 3}, ms(10, 20, 30, 40, 10, 20, 30, 40))
+	if b.LoopCount != 2 {
+		t.Errorf("Unroll: LoopCount %d, want 2", b.LoopCount)
+	}
+
+	b, err := Trim(a, 15*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, "Trim", a, b, []int{1, 2}, ms(15, 20))
+	if _, err := Trim(a, 200*time.Millisecond, time.Second); err == nil {
+		t.Error("Trim: no error for a range past the end")
+	}
+
+	b, err = Speed(a, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, "Speed", a, b, []int{0, 1, 2, 3}, ms(2.5, 5, 7.5, 10))
+
+	// 16-bit frames are kept as they are, so repeated frames must be
+	// copies.
+	deep := movingSquare(4, func(r image.Rectangle) image.Image { return image.NewNRGBA64(r) })
+	checkUnshared(t, "PingPong", PingPong(deep))
+	checkUnshared(t, "Unroll", Unroll(deep, 3))
+}
+
+func TestSpeedDelayLimits(t *testing.T) {
+	a := APNG{Frames: []Frame{
+		{DelayNumerator: 30000, DelayDenominator: 1},
+		{DelayNumerator: 1, DelayDenominator: 3},
+	}}
+	b, err := Speed(a, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := b.Frames[0]; f.DelayNumerator != 65535 || f.DelayDenominator != 1 {
+		t.Errorf("got delay %d/%d, want the longest delay", f.DelayNumerator, f.DelayDenominator)
+	}
+	if f := b.Frames[1]; f.DelayNumerator != 4 || f.DelayDenominator != 3 {
+		t.Errorf("got delay %d/%d, want 4/3", f.DelayNumerator, f.DelayDenominator)
+	}
+	if a.Frames[0].DelayNumerator != 30000 {
+		t.Error("Speed changed its input")
+	}
+	b, err = Speed(a, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := b.Frames[1]; f.DelayNumerator != 1 || f.DelayDenominator != 9 {
+		t.Errorf("got delay %d/%d, want 1/9", f.DelayNumerator, f.DelayDenominator)
+	}
+	if _, err := Speed(a, 0); err == nil {
+		t.Error("no error for a speed of 0")
+	}
+}
+
+// ms returns the given numbers of milliseconds as durations.
+func ms(v ...float64) []time.Duration {
+	d := make([]time.Duration, len(v))
+	for i := range v {
+		d[i] = time.Duration(v[i] * float64(time.Millisecond))
+	}
+	return d
+}
+
+func TestDecimate(t *testing.T) {
+	// The delays are 10ms to 60ms, and the frames start at 0ms, 10ms, 30ms,
+	// 60ms, 100ms and 150ms.
+	a := deltaSquare(t, 6)
+
+	b, err := Decimate(a, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, "3 frames", a, b, []int{0, 3, 4}, ms(60, 40, 110))
+
+	b, err = Decimate(a, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, "10 fps", a, b, []int{0, 4}, ms(100, 110))
+
+	b, err = Decimate(a, 4, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, "4 frames at 100 fps", a, b, []int{0, 2, 4, 5}, ms(30, 70, 50, 60))
+
+	b, err = Decimate(a, 6, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &b.Frames[0] != &a.Frames[0] {
+		t.Error("an APNG within the limits was changed")
+	}
+
+	if _, err := Decimate(a, -1, 0); err == nil {
+		t.Error("no error for a negative frame count")
+	}
+
+	// Each kept frame is shown for 500.005s, which has to be rounded to fit
+	// in 16 bits, to a multiple of 1/131 at best. The rounding is carried
+	// over, so the total is only off by the last frame's, under 4ms, rather
+	// than by 26ms.
+	var long APNG
+	for i := 0; i < 20; i++ {
+		f := solidFrame(color.NRGBA{uint8(i), 0, 0, 255}, 0)
+		f.DelayNumerator, f.DelayDenominator = 500, 1
+		if i%2 == 1 {
+			f.DelayNumerator, f.DelayDenominator = 1, 200
+		}
+		long.Frames = append(long.Frames, f)
+	}
+	b, err = Decimate(long, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Frames) != 10 {
+		t.Fatalf("rounded delays: got %d frames, want 10", len(b.Frames))
+	}
+	want, got := new(big.Rat), new(big.Rat)
+	for i := range long.Frames {
+		want.Add(want, long.Frames[i].delayRat())
+	}
+	for i := range b.Frames {
+		got.Add(got, b.Frames[i].delayRat())
+	}
+	if diff := new(big.Rat).Sub(got, want); diff.Abs(diff).Cmp(big.NewRat(4, 1000)) > 0 {
+		t.Errorf("rounded delays: total duration is %s, want %s", got.FloatString(6), want.FloatString(6))
+	}
+}
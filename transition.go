@@ -0,0 +1,294 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"context"
+	"image"
+	"strconv"
+	"time"
+)
+
+// Anchor selects where an animation is placed on a larger canvas.
+type Anchor int
+
+// The anchors place an animation at the center of the canvas, at one of its
+// corners or at the middle of one of its edges.
+const (
+	AnchorCenter Anchor = iota
+	AnchorTopLeft
+	AnchorTop
+	AnchorTopRight
+	AnchorLeft
+	AnchorRight
+	AnchorBottomLeft
+	AnchorBottom
+	AnchorBottomRight
+)
+
+// offset returns where an image of size s is placed on a canvas of size c.
+func (an Anchor) offset(s, c image.Point) image.Point {
+	// fx and fy are the fraction of the free space, in halves, that is left
+	// of and above the image.
+	fx, fy := 1, 1
+	switch an {
+	case AnchorTopLeft, AnchorLeft, AnchorBottomLeft:
+		fx = 0
+	case AnchorTopRight, AnchorRight, AnchorBottomRight:
+		fx = 2
+	}
+	switch an {
+	case AnchorTopLeft, AnchorTop, AnchorTopRight:
+		fy = 0
+	case AnchorBottomLeft, AnchorBottom, AnchorBottomRight:
+		fy = 2
+	}
+	return image.Pt((c.X-s.X)*fx/2, (c.Y-s.Y)*fy/2)
+}
+
+// Direction is the direction that a Wipe's edge, or a Slide's animations,
+// move in.
+type Direction int
+
+// The directions of a Wipe or Slide.
+const (
+	DirectionLeft Direction = iota
+	DirectionRight
+	DirectionUp
+	DirectionDown
+)
+
+// Transition builds animations that change from one APNG to another. The
+// result plays the first APNG, then a transition of the given duration
+// during which the end of the first and the start of the second play at
+// once, and then the rest of the second. It takes as long as both minus the
+// duration, if both are at least that long, and plays once. An APNG shorter
+// than the duration stays on its last frame. The transition has the given
+// number of steps, shown for an equal part of the duration each, at evenly
+// spaced points from the first to the second. The last step shows only the
+// second, as it is at the end of the transition, so that an APNG shorter
+// than the duration ends on its last frame. A default image is used as a
+// still frame for an APNG without an animation.
+//
+// The result is passed through the Encoder's DeltaFrames, so that each frame
+// only covers what changed, and its images are 16-bit if either APNG's
+// first frame is, and 8-bit otherwise.
+type Transition struct {
+	// Anchor places each APNG on the canvas, whose size is the largest width
+	// and height of the two, when they differ in size. The rest of the
+	// canvas is transparent.
+	Anchor Anchor
+}
+
+// Crossfade returns an animation that fades from a to b, as per
+// Transition.Crossfade.
+func Crossfade(a, b APNG, duration time.Duration, steps int) (APNG, error) {
+	var t Transition
+	return t.Crossfade(a, b, duration, steps)
+}
+
+// Wipe returns an animation that wipes from a to b, as per Transition.Wipe.
+func Wipe(a, b APNG, duration time.Duration, steps int, dir Direction) (APNG, error) {
+	var t Transition
+	return t.Wipe(a, b, duration, steps, dir)
+}
+
+// Slide returns an animation that slides from a to b, as per
+// Transition.Slide.
+func Slide(a, b APNG, duration time.Duration, steps int, dir Direction) (APNG, error) {
+	var t Transition
+	return t.Slide(a, b, duration, steps, dir)
+}
+
+// Crossfade returns an animation that fades from a to b. Colors are mixed
+// with their alpha premultiplied, so that transparent pixels don't darken
+// the result.
+func (t *Transition) Crossfade(a, b APNG, duration time.Duration, steps int) (APNG, error) {
+	return t.build(a, b, duration, steps, func(dst, m0, m1 *image.NRGBA64, p float64) {
+		mix(dst, m0, m1, p)
+	})
+}
+
+// Wipe returns an animation in which b is uncovered over a by an edge
+// moving in the direction dir, from one side of the canvas to the other.
+func (t *Transition) Wipe(a, b APNG, duration time.Duration, steps int, dir Direction) (APNG, error) {
+	if dir < DirectionLeft || dir > DirectionDown {
+		return a, UnsupportedError("direction " + strconv.Itoa(int(dir)))
+	}
+	return t.build(a, b, duration, steps, func(dst, m0, m1 *image.NRGBA64, p float64) {
+		w, h := dst.Rect.Dx(), dst.Rect.Dy()
+		copy(dst.Pix, m0.Pix)
+		var r image.Rectangle
+		switch dir {
+		case DirectionLeft:
+			r = image.Rect(w-round(p*float64(w)), 0, w, h)
+		case DirectionRight:
+			r = image.Rect(0, 0, round(p*float64(w)), h)
+		case DirectionUp:
+			r = image.Rect(0, h-round(p*float64(h)), w, h)
+		case DirectionDown:
+			r = image.Rect(0, 0, w, round(p*float64(h)))
+		}
+		copyRect(dst, r, m1, r.Min)
+	})
+}
+
+// Slide returns an animation in which b pushes a off the canvas, both
+// moving in the direction dir.
+func (t *Transition) Slide(a, b APNG, duration time.Duration, steps int, dir Direction) (APNG, error) {
+	if dir < DirectionLeft || dir > DirectionDown {
+		return a, UnsupportedError("direction " + strconv.Itoa(int(dir)))
+	}
+	return t.build(a, b, duration, steps, func(dst, m0, m1 *image.NRGBA64, p float64) {
+		w, h := dst.Rect.Dx(), dst.Rect.Dy()
+		switch dir {
+		case DirectionLeft:
+			o := round(p * float64(w))
+			copyRect(dst, image.Rect(0, 0, w-o, h), m0, image.Pt(o, 0))
+			copyRect(dst, image.Rect(w-o, 0, w, h), m1, image.Pt(0, 0))
+		case DirectionRight:
+			o := round(p * float64(w))
+			copyRect(dst, image.Rect(0, 0, o, h), m1, image.Pt(w-o, 0))
+			copyRect(dst, image.Rect(o, 0, w, h), m0, image.Pt(0, 0))
+		case DirectionUp:
+			o := round(p * float64(h))
+			copyRect(dst, image.Rect(0, 0, w, h-o), m0, image.Pt(0, o))
+			copyRect(dst, image.Rect(0, h-o, w, h), m1, image.Pt(0, 0))
+		case DirectionDown:
+			o := round(p * float64(h))
+			copyRect(dst, image.Rect(0, 0, w, o), m1, image.Pt(0, h-o))
+			copyRect(dst, image.Rect(0, o, w, h), m0, image.Pt(0, 0))
+		}
+	})
+}
+
+// build returns the animation from a to b, with each step of the transition
+// drawn into dst by effect from the canvases of a and b, m0 and m1, that are
+// shown at its start. p is how far along the transition the step is, from
+// 0 to 1, not including 0. The last step, with p of 1, is given the canvas
+// of b shown at the end of the transition.
+func (t *Transition) build(a, b APNG, duration time.Duration, steps int, effect func(dst, m0, m1 *image.NRGBA64, p float64)) (APNG, error) {
+	if duration <= 0 {
+		return a, FormatError("invalid transition duration: " + duration.String())
+	}
+	if steps < 1 {
+		return a, FormatError("invalid number of transition steps: " + strconv.Itoa(steps))
+	}
+	a, ok := stillOrAnimation(a)
+	b, ok1 := stillOrAnimation(b)
+	if !ok || !ok1 {
+		return a, FormatError("transition to or from an APNG without frames")
+	}
+	ta, tb := newTimeline(a), newTimeline(b)
+	sa, sb := ta.canvases[0].Rect.Size(), tb.canvases[0].Rect.Size()
+	size := sa
+	if sb.X > size.X {
+		size.X = sb.X
+	}
+	if sb.Y > size.Y {
+		size.Y = sb.Y
+	}
+	canvas := image.Rectangle{Max: size}
+	// place returns m on the canvas, as anchored.
+	place := func(m *image.NRGBA64) *image.NRGBA64 {
+		if m.Rect.Size() == size {
+			return m
+		}
+		n := image.NewNRGBA64(canvas)
+		o := t.Anchor.offset(m.Rect.Size(), size)
+		copyRect(n, m.Rect.Add(o), m, image.Point{})
+		return n
+	}
+
+	var frames []Frame
+	// add adds the canvases of tl shown from start to end, with their own
+	// delays where they aren't cut short.
+	add := func(tl timeline, src APNG, start, end time.Duration) {
+		for i, m := range tl.canvases {
+			s, e := tl.starts[i], tl.starts[i+1]
+			fr := animationFrames(src)[i]
+			f := Frame{DelayNumerator: fr.DelayNumerator, DelayDenominator: fr.DelayDenominator}
+			if s < start || e > end {
+				if s < start {
+					s = start
+				}
+				if e > end {
+					e = end
+				}
+				f.SetDuration(e - s)
+			}
+			if e > s {
+				f.Image = place(m)
+				frames = append(frames, f)
+			}
+		}
+	}
+
+	cut := ta.total() - duration
+	if cut < 0 {
+		cut = 0
+	}
+	add(ta, a, 0, cut)
+	var prev time.Duration
+	for k := 0; k < steps; k++ {
+		next := time.Duration(int64(duration) * int64(k+1) / int64(steps))
+		j := tb.at(prev)
+		if k == steps-1 {
+			j = tb.at(duration - 1)
+		}
+		m := image.NewNRGBA64(canvas)
+		effect(m, place(ta.canvases[ta.at(cut+prev)]), place(tb.canvases[j]), float64(k+1)/float64(steps))
+		f := Frame{Image: m}
+		f.SetDuration(next - prev)
+		frames = append(frames, f)
+		prev = next
+	}
+	add(tb, b, duration, tb.total())
+
+	orig := animationFrames(a)[0].Image
+	if m := animationFrames(b)[0].Image; !is8Bit(m.ColorModel()) {
+		orig = m
+	}
+	convertDeltaFrames(frames, orig)
+	enc := Encoder{DeltaFrames: true}
+	return enc.deltaFrames(context.Background(), APNG{Frames: frames, LoopCount: 1})
+}
+
+// stillOrAnimation returns a, or an animation of its default image if it
+// has no animation. It reports false if a has no frames.
+func stillOrAnimation(a APNG) (APNG, bool) {
+	if len(a.Frames) == 0 {
+		return a, false
+	}
+	if len(animationFrames(a)) == 0 {
+		return APNG{Frames: []Frame{{Image: a.Frames[0].Image}}}, true
+	}
+	return a, true
+}
+
+// mix sets dst to m0 and m1 mixed, with m1 weighted by p and m0 by 1-p.
+func mix(dst, m0, m1 *image.NRGBA64, p float64) {
+	for i := 0; i < len(dst.Pix); i += 8 {
+		a0 := (1 - p) * float64(uint16(m0.Pix[i+6])<<8|uint16(m0.Pix[i+7]))
+		a1 := p * float64(uint16(m1.Pix[i+6])<<8|uint16(m1.Pix[i+7]))
+		a := a0 + a1
+		if a == 0 {
+			continue
+		}
+		for c := 0; c < 6; c += 2 {
+			v0 := float64(uint16(m0.Pix[i+c])<<8 | uint16(m0.Pix[i+c+1]))
+			v1 := float64(uint16(m1.Pix[i+c])<<8 | uint16(m1.Pix[i+c+1]))
+			v := uint16((v0*a0+v1*a1)/a + 0.5)
+			dst.Pix[i+c], dst.Pix[i+c+1] = uint8(v>>8), uint8(v)
+		}
+		v := uint16(a + 0.5)
+		dst.Pix[i+6], dst.Pix[i+7] = uint8(v>>8), uint8(v)
+	}
+}
+
+// round returns v rounded to the nearest integer.
+func round(v float64) int {
+	return int(v + 0.5)
+}
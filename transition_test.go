@@ -0,0 +1,154 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// checkColorAt checks that the canvas of tl shown at time t has the color c
+// at (x, y), give or take 1 in each channel.
+func checkColorAt(t *testing.T, name string, tl timeline, at time.Duration, x, y int, c color.NRGBA) {
+	t.Helper()
+	got := color.NRGBAModel.Convert(tl.canvases[tl.at(at)].At(x, y)).(color.NRGBA)
+	d := func(a, b uint8) bool { return int(a) > int(b)+1 || int(b) > int(a)+1 }
+	if d(got.R, c.R) || d(got.G, c.G) || d(got.B, c.B) || d(got.A, c.A) {
+		t.Errorf("%s: at %v, (%d, %d) is %v, want %v", name, at, x, y, got, c)
+	}
+}
+
+func TestCrossfade(t *testing.T) {
+	red, green, blue, white := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0xff, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}, color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	a := APNG{Frames: []Frame{solidFrame(red, 100), solidFrame(green, 100)}}
+	b := APNG{Frames: []Frame{solidFrame(blue, 100), solidFrame(white, 100)}}
+	c, err := Crossfade(a, b, 100*time.Millisecond, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := newTimeline(c)
+	if tl.total() != 300*time.Millisecond {
+		t.Errorf("got a total duration of %v, want 300ms", tl.total())
+	}
+	if c.LoopCount != 1 {
+		t.Errorf("got a LoopCount of %d, want 1", c.LoopCount)
+	}
+	checkColorAt(t, "Crossfade", tl, 50*time.Millisecond, 0, 0, red)
+	// The steps are a quarter, a half, and so on, of the way from green to
+	// blue, and the last is all of the way.
+	checkColorAt(t, "Crossfade", tl, 110*time.Millisecond, 0, 0, color.NRGBA{0, 191, 64, 0xff})
+	checkColorAt(t, "Crossfade", tl, 160*time.Millisecond, 0, 0, color.NRGBA{0, 64, 191, 0xff})
+	checkColorAt(t, "Crossfade", tl, 190*time.Millisecond, 0, 0, blue)
+	checkColorAt(t, "Crossfade", tl, 250*time.Millisecond, 0, 0, white)
+
+	if _, err := Crossfade(a, b, time.Second, 0); err == nil {
+		t.Error("no error for 0 steps")
+	}
+}
+
+func TestWipeSlide(t *testing.T) {
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+	a := APNG{Frames: []Frame{solidFrame(red, 100)}}
+	b := APNG{Frames: []Frame{solidFrame(blue, 100)}}
+
+	// The first of two steps is halfway.
+	for _, test := range []struct {
+		dir       Direction
+		red, blue image.Point
+	}{
+		{DirectionLeft, image.Pt(1, 0), image.Pt(2, 0)},
+		{DirectionRight, image.Pt(2, 0), image.Pt(1, 0)},
+		{DirectionUp, image.Pt(0, 1), image.Pt(0, 2)},
+		{DirectionDown, image.Pt(0, 2), image.Pt(0, 1)},
+	} {
+		for name, f := range map[string]func(a, b APNG, d time.Duration, steps int, dir Direction) (APNG, error){"Wipe": Wipe, "Slide": Slide} {
+			c, err := f(a, b, 50*time.Millisecond, 2, test.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tl := newTimeline(c)
+			checkColorAt(t, name, tl, 60*time.Millisecond, test.red.X, test.red.Y, red)
+			checkColorAt(t, name, tl, 60*time.Millisecond, test.blue.X, test.blue.Y, blue)
+			checkColorAt(t, name, tl, 80*time.Millisecond, test.red.X, test.red.Y, blue)
+			checkColorAt(t, name, tl, 120*time.Millisecond, 0, 0, blue)
+		}
+	}
+
+	// The frames of the wipe only cover the columns that change.
+	c, err := Wipe(a, b, 40*time.Millisecond, 4, DirectionRight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range c.Frames[1:] {
+		if w := f.Image.Bounds().Dx(); w > 1 {
+			t.Errorf("a frame is %d pixels wide, want 1", w)
+		}
+	}
+}
+
+func TestTransitionEndsOnLastFrame(t *testing.T) {
+	red, blue, white := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}, color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	a := APNG{Frames: []Frame{solidFrame(red, 100)}}
+	for _, b := range []APNG{
+		// b is longer than the transition.
+		{Frames: []Frame{solidFrame(blue, 100), solidFrame(white, 100)}},
+		// b ends during the transition's last step, which starts at 50ms.
+		{Frames: []Frame{solidFrame(blue, 60), solidFrame(white, 20)}},
+	} {
+		for name, f := range map[string]func(a, b APNG) (APNG, error){
+			"Crossfade": func(a, b APNG) (APNG, error) { return Crossfade(a, b, 100*time.Millisecond, 2) },
+			"Wipe":      func(a, b APNG) (APNG, error) { return Wipe(a, b, 100*time.Millisecond, 2, DirectionLeft) },
+			"Slide":     func(a, b APNG) (APNG, error) { return Slide(a, b, 100*time.Millisecond, 2, DirectionUp) },
+		} {
+			c, err := f(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, want := composite(c), composite(b)
+			if err := diff(want[len(want)-1], got[len(got)-1]); err != nil {
+				t.Errorf("%s, b of %v: last frame: %v", name, newTimeline(b).total(), err)
+			}
+		}
+	}
+}
+
+func TestTransitionAnchor(t *testing.T) {
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+	big := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	for i := 0; i < len(big.Pix); i += 4 {
+		copy(big.Pix[i:], []uint8{blue.R, blue.G, blue.B, blue.A})
+	}
+	a := APNG{Frames: []Frame{solidFrame(red, 100)}}
+	b := APNG{Frames: []Frame{{Image: big, DelayNumerator: 1, DelayDenominator: 10}}}
+	for _, test := range []struct {
+		anchor Anchor
+		min    image.Point
+	}{
+		{AnchorCenter, image.Pt(2, 1)},
+		{AnchorTopLeft, image.Pt(0, 0)},
+		{AnchorBottomRight, image.Pt(4, 2)},
+		{AnchorTop, image.Pt(2, 0)},
+	} {
+		tr := Transition{Anchor: test.anchor}
+		c, err := tr.Crossfade(a, b, 50*time.Millisecond, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tl := newTimeline(c)
+		if s := tl.canvases[0].Rect.Size(); s != image.Pt(8, 6) {
+			t.Fatalf("anchor %d: the canvas is %v, want 8x6", test.anchor, s)
+		}
+		checkColorAt(t, "anchor", tl, 0, test.min.X, test.min.Y, red)
+		checkColorAt(t, "anchor", tl, 0, test.min.X+3, test.min.Y+3, red)
+		if test.min.X > 0 {
+			checkColorAt(t, "anchor", tl, 0, test.min.X-1, test.min.Y, color.NRGBA{})
+		}
+		if test.min.X < 4 {
+			checkColorAt(t, "anchor", tl, 0, test.min.X+4, test.min.Y, color.NRGBA{})
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"encoding/binary"
+)
+
+// Masks for operating on the 8 bytes of a uint64 at once.
+const (
+	lowBits  = 0x7f7f7f7f7f7f7f7f
+	highBits = 0x8080808080808080
+)
+
+// addBytes adds each byte of x to the same byte of y, modulo 256, without
+// carrying into the next byte.
+func addBytes(x, y uint64) uint64 {
+	return ((x &^ highBits) + (y &^ highBits)) ^ ((x ^ y) & highBits)
+}
+
+// averageBytes returns the average of each byte of x and the same byte of y,
+// rounded down, as the Average filter needs.
+func averageBytes(x, y uint64) uint64 {
+	return (x & y) + ((x ^ y) >> 1 & lowBits)
+}
+
+// unfilter reverses the filter ft of the current row cdat, given the
+// previous row pdat and the number of bytes per pixel, rounded up to 1. It
+// reports false if ft is not a valid filter type.
+func unfilter(ft uint8, cdat, pdat []byte, bytesPerPixel int) bool {
+	switch ft {
+	case ftNone:
+		// No-op.
+	case ftSub:
+		unfilterSub(cdat, bytesPerPixel)
+	case ftUp:
+		unfilterUp(cdat, pdat)
+	case ftAverage:
+		unfilterAverage(cdat, pdat, bytesPerPixel)
+	case ftPaeth:
+		switch bytesPerPixel {
+		case 1:
+			filterPaeth1(cdat, pdat)
+		case 2:
+			filterPaeth2(cdat, pdat)
+		case 3:
+			filterPaeth3(cdat, pdat)
+		case 4:
+			filterPaeth4(cdat, pdat)
+		case 6:
+			filterPaeth6(cdat, pdat)
+		case 8:
+			filterPaeth8(cdat, pdat)
+		default:
+			filterPaeth(cdat, pdat, bytesPerPixel)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// unfilterSub reverses the Sub filter. Rows of 4 and 8 byte pixels are
+// handled a whole pixel at a time.
+func unfilterSub(cdat []byte, bytesPerPixel int) {
+	switch bytesPerPixel {
+	case 1:
+		a := cdat[0]
+		for i := 1; i < len(cdat); i++ {
+			a += cdat[i]
+			cdat[i] = a
+		}
+	case 2:
+		a0, a1 := cdat[0], cdat[1]
+		for i := 2; i+2 <= len(cdat); i += 2 {
+			a0 += cdat[i+0]
+			a1 += cdat[i+1]
+			cdat[i+0], cdat[i+1] = a0, a1
+		}
+	case 3:
+		a0, a1, a2 := cdat[0], cdat[1], cdat[2]
+		for i := 3; i+3 <= len(cdat); i += 3 {
+			a0 += cdat[i+0]
+			a1 += cdat[i+1]
+			a2 += cdat[i+2]
+			cdat[i+0], cdat[i+1], cdat[i+2] = a0, a1, a2
+		}
+	case 4:
+		a := uint64(binary.LittleEndian.Uint32(cdat))
+		for i := 4; i+4 <= len(cdat); i += 4 {
+			a = addBytes(a, uint64(binary.LittleEndian.Uint32(cdat[i:])))
+			binary.LittleEndian.PutUint32(cdat[i:], uint32(a))
+		}
+	case 6:
+		a0, a1, a2 := cdat[0], cdat[1], cdat[2]
+		a3, a4, a5 := cdat[3], cdat[4], cdat[5]
+		for i := 6; i+6 <= len(cdat); i += 6 {
+			a0 += cdat[i+0]
+			a1 += cdat[i+1]
+			a2 += cdat[i+2]
+			a3 += cdat[i+3]
+			a4 += cdat[i+4]
+			a5 += cdat[i+5]
+			cdat[i+0], cdat[i+1], cdat[i+2] = a0, a1, a2
+			cdat[i+3], cdat[i+4], cdat[i+5] = a3, a4, a5
+		}
+	case 8:
+		a := binary.LittleEndian.Uint64(cdat)
+		for i := 8; i+8 <= len(cdat); i += 8 {
+			a = addBytes(a, binary.LittleEndian.Uint64(cdat[i:]))
+			binary.LittleEndian.PutUint64(cdat[i:], a)
+		}
+	default:
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bytesPerPixel]
+		}
+	}
+}
+
+// unfilterUp reverses the Up filter, 8 bytes at a time.
+func unfilterUp(cdat, pdat []byte) {
+	i := 0
+	for ; i+8 <= len(cdat); i += 8 {
+		c := binary.LittleEndian.Uint64(cdat[i:])
+		p := binary.LittleEndian.Uint64(pdat[i:])
+		binary.LittleEndian.PutUint64(cdat[i:], addBytes(c, p))
+	}
+	for ; i < len(cdat); i++ {
+		cdat[i] += pdat[i]
+	}
+}
+
+// unfilterAverage reverses the Average filter. Rows of 2, 3, 4, 6 and 8
+// byte pixels are handled a whole pixel at a time.
+func unfilterAverage(cdat, pdat []byte, bytesPerPixel int) {
+	// The first column has no column to the left of it, so it is a special
+	// case. We know that the first column exists because the caller checks
+	// that width != 0, and so len(cdat) != 0.
+	for i := 0; i < bytesPerPixel; i++ {
+		cdat[i] += pdat[i] / 2
+	}
+	switch bytesPerPixel {
+	case 1:
+		a := cdat[0]
+		for i := 1; i < len(cdat); i++ {
+			a = cdat[i] + uint8((uint(a)+uint(pdat[i]))/2)
+			cdat[i] = a
+		}
+	case 2:
+		a0, a1 := uint(cdat[0]), uint(cdat[1])
+		for i := 2; i+2 <= len(cdat); i += 2 {
+			a0 = uint(cdat[i+0]+uint8((a0+uint(pdat[i+0]))/2)) & 0xff
+			a1 = uint(cdat[i+1]+uint8((a1+uint(pdat[i+1]))/2)) & 0xff
+			cdat[i+0], cdat[i+1] = uint8(a0), uint8(a1)
+		}
+	case 3:
+		a0, a1, a2 := uint(cdat[0]), uint(cdat[1]), uint(cdat[2])
+		for i := 3; i+3 <= len(cdat); i += 3 {
+			a0 = uint(cdat[i+0]+uint8((a0+uint(pdat[i+0]))/2)) & 0xff
+			a1 = uint(cdat[i+1]+uint8((a1+uint(pdat[i+1]))/2)) & 0xff
+			a2 = uint(cdat[i+2]+uint8((a2+uint(pdat[i+2]))/2)) & 0xff
+			cdat[i+0], cdat[i+1], cdat[i+2] = uint8(a0), uint8(a1), uint8(a2)
+		}
+	case 4:
+		a := uint64(binary.LittleEndian.Uint32(cdat))
+		for i := 4; i+4 <= len(cdat); i += 4 {
+			c := uint64(binary.LittleEndian.Uint32(cdat[i:]))
+			p := uint64(binary.LittleEndian.Uint32(pdat[i:]))
+			a = addBytes(c, averageBytes(a, p))
+			binary.LittleEndian.PutUint32(cdat[i:], uint32(a))
+		}
+	case 6:
+		a0, a1, a2 := uint(cdat[0]), uint(cdat[1]), uint(cdat[2])
+		a3, a4, a5 := uint(cdat[3]), uint(cdat[4]), uint(cdat[5])
+		for i := 6; i+6 <= len(cdat); i += 6 {
+			a0 = uint(cdat[i+0]+uint8((a0+uint(pdat[i+0]))/2)) & 0xff
+			a1 = uint(cdat[i+1]+uint8((a1+uint(pdat[i+1]))/2)) & 0xff
+			a2 = uint(cdat[i+2]+uint8((a2+uint(pdat[i+2]))/2)) & 0xff
+			a3 = uint(cdat[i+3]+uint8((a3+uint(pdat[i+3]))/2)) & 0xff
+			a4 = uint(cdat[i+4]+uint8((a4+uint(pdat[i+4]))/2)) & 0xff
+			a5 = uint(cdat[i+5]+uint8((a5+uint(pdat[i+5]))/2)) & 0xff
+			cdat[i+0], cdat[i+1], cdat[i+2] = uint8(a0), uint8(a1), uint8(a2)
+			cdat[i+3], cdat[i+4], cdat[i+5] = uint8(a3), uint8(a4), uint8(a5)
+		}
+	case 8:
+		a := binary.LittleEndian.Uint64(cdat)
+		for i := 8; i+8 <= len(cdat); i += 8 {
+			c := binary.LittleEndian.Uint64(cdat[i:])
+			p := binary.LittleEndian.Uint64(pdat[i:])
+			a = addBytes(c, averageBytes(a, p))
+			binary.LittleEndian.PutUint64(cdat[i:], a)
+		}
+	default:
+		for i := bytesPerPixel; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 kts of kettek / Ketchetwahmeegwun Tecumseh Southall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// slowUnfilter is a slow but simple implementation of func unfilter, as per
+// the PNG spec, section 9.
+func slowUnfilter(ft uint8, cdat, pdat []byte, bytesPerPixel int) {
+	for i := range cdat {
+		var a, c uint8
+		if i >= bytesPerPixel {
+			a, c = cdat[i-bytesPerPixel], pdat[i-bytesPerPixel]
+		}
+		b := pdat[i]
+		switch ft {
+		case ftSub:
+			cdat[i] += a
+		case ftUp:
+			cdat[i] += b
+		case ftAverage:
+			cdat[i] += uint8((int(a) + int(b)) / 2)
+		case ftPaeth:
+			cdat[i] += slowPaeth(a, b, c)
+		}
+	}
+}
+
+func TestUnfilter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for ft := uint8(ftNone); ft < nFilter; ft++ {
+		for bytesPerPixel := 1; bytesPerPixel <= 8; bytesPerPixel++ {
+			for _, pixels := range []int{1, 2, 3, 5, 17, 64} {
+				n := pixels * bytesPerPixel
+				pdat := make([]byte, n)
+				cdat0 := make([]byte, n)
+				for i := range pdat {
+					pdat[i] = uint8(r.Uint32())
+					cdat0[i] = uint8(r.Uint32())
+				}
+				got := append([]byte(nil), cdat0...)
+				want := append([]byte(nil), cdat0...)
+				if !unfilter(ft, got, pdat, bytesPerPixel) {
+					t.Fatalf("filter %d: not accepted", ft)
+				}
+				slowUnfilter(ft, want, pdat, bytesPerPixel)
+				if !bytes.Equal(got, want) {
+					t.Errorf("filter %d, bytesPerPixel %d, %d pixels:\npdat:  % x\ncdat:  % x\ngot:   % x\nwant:  % x",
+						ft, bytesPerPixel, pixels, pdat, cdat0, got, want)
+				}
+			}
+		}
+	}
+	if unfilter(nFilter, []byte{0}, []byte{0}, 1) {
+		t.Errorf("filter %d: accepted", nFilter)
+	}
+}
+
+// colorTypeImages returns an image for each PNG color type and bit depth
+// that the encoder writes, with noise so that every filter gets used.
+func colorTypeImages(width, height int) map[string]image.Image {
+	r := rand.New(rand.NewSource(1))
+	rect := image.Rect(0, 0, width, height)
+	m := map[string]image.Image{}
+	gray := image.NewGray(rect)
+	gray16 := image.NewGray16(rect)
+	rgba := image.NewRGBA(rect)
+	nrgba := image.NewNRGBA(rect)
+	rgba64 := image.NewRGBA64(rect)
+	nrgba64 := image.NewNRGBA64(rect)
+	keyed := image.NewNRGBA(rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x*3+y*5) + uint8(r.Intn(8))
+			gray.SetGray(x, y, color.Gray{v})
+			gray16.SetGray16(x, y, color.Gray16{uint16(v)<<8 | uint16(r.Intn(256))})
+			rgba.SetRGBA(x, y, color.RGBA{v, v ^ 0x55, uint8(y), 0xff})
+			nrgba.SetNRGBA(x, y, color.NRGBA{v, uint8(x), v ^ 0x33, uint8(r.Intn(256))})
+			rgba64.SetRGBA64(x, y, color.RGBA64{uint16(v) << 8, uint16(x) * 0x101, uint16(r.Intn(65536)), 0xffff})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{uint16(r.Intn(65536)), uint16(v) << 8, 0x1234, uint16(r.Intn(65536))})
+			c := color.NRGBA{v, uint8(y), 0x80, 0xff}
+			if (x+y)%7 == 0 {
+				c = color.NRGBA{}
+			}
+			keyed.SetNRGBA(x, y, c)
+		}
+	}
+	m["gray8"], m["gray16"], m["rgb8"], m["rgba8"] = gray, gray16, rgba, nrgba
+	m["rgb16"], m["rgba16"], m["rgb8-trns"] = rgba64, nrgba64, keyed
+	for _, n := range []int{2, 4, 16, 256} {
+		pal := make(color.Palette, n)
+		for i := range pal {
+			pal[i] = color.NRGBA{uint8(i * 7), uint8(i * 13), uint8(i * 29), uint8(0xff - i%3)}
+		}
+		p := image.NewPaletted(rect, pal)
+		for i := range p.Pix {
+			p.Pix[i] = uint8(r.Intn(n))
+		}
+		m[fmt.Sprintf("paletted%d", n)] = p
+	}
+	return m
+}
+
+func TestDecodeMatchesImagePNG(t *testing.T) {
+	filters := []FilterStrategy{NoneFilter, SubFilter, UpFilter, AverageFilter, PaethFilter, AdaptiveFilter}
+	for name, m := range colorTypeImages(37, 11) {
+		for _, f := range filters {
+			for _, interlaced := range []bool{false, true} {
+				var buf bytes.Buffer
+				enc := &Encoder{FilterStrategy: f, Interlaced: interlaced}
+				if err := enc.Encode(&buf, APNG{Frames: []Frame{{Image: m}}}); err != nil {
+					t.Fatal(err)
+				}
+				want, err := png.Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("%s: image/png: %v", name, err)
+				}
+				got, err := Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) {
+					t.Errorf("%s: got %T, want %T", name, got, want)
+				}
+				if err := diff(want, got); err != nil {
+					t.Errorf("%s, filter %d, interlaced %v: %v", name, f, interlaced, err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for name, m := range colorTypeImages(640, 480) {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, m); err != nil {
+			b.Fatal(err)
+		}
+		data := buf.Bytes()
+		b.Run(name+"/apng", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/png", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -9,13 +9,18 @@ package apng
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/zlib"
+	"context"
 	"encoding/binary"
 	"hash/crc32"
 	"image"
 	"image/color"
 	"io"
+	"math"
 	"strconv"
+	"time"
 )
 
 // Encoder configures encoding PNG images.
@@ -23,12 +28,78 @@ type Encoder struct {
 	CompressionLevel CompressionLevel
 
 	// BufferPool optionally specifies a buffer pool to get temporary
-	// EncoderBuffers when encoding an image.
+	// EncoderBuffers when encoding an image. When Concurrency is above 1,
+	// it must be safe to call from several goroutines.
 	BufferPool EncoderBufferPool
 
 	// CompressionWriter optionally provides a external zlib compression
 	// writer for writing PNG image data.
 	CompressionWriter func(w io.Writer) (CompressionWriter, error)
+
+	// CompressionStrategy selects how repeated data is searched for when
+	// compressing image data. It is ignored when CompressionWriter is set or
+	// when CompressionLevel is NoCompression.
+	CompressionStrategy CompressionStrategy
+
+	// FilterStrategy selects the PNG row filter applied before compression.
+	FilterStrategy FilterStrategy
+
+	// ChunkSize is the maximum number of bytes of compressed image data
+	// written to each IDAT or fdAT chunk. Zero means 32 KiB. Larger chunks
+	// have less overhead, but readers must buffer more before they can
+	// verify a chunk's checksum.
+	ChunkSize int
+
+	// Concurrency is the number of goroutines that compress the image data
+	// of frames at the same time. Each uses its own EncoderBuffer from
+	// BufferPool, if set. Chunks are still written in order. Values below 2
+	// compress each frame in turn on the calling goroutine. When set,
+	// CompressionWriter must be safe to call from several goroutines.
+	Concurrency int
+
+	// DeltaFrames writes each frame after the first as only the region that
+	// changed since the frame before, choosing XOffset, YOffset, DisposeOp and
+	// BlendOp for the smallest output. The frames are composited first, so
+	// they are usually full-canvas images, but may use offsets and blending
+	// themselves. This can shrink animations such as screen recordings many
+	// times over.
+	DeltaFrames bool
+
+	// LossyTolerance is the largest change, in 8-bit units, in any channel
+	// of a pixel that is not written. Pixels that change less than this from
+	// what is already displayed are left as they are, which lets whole
+	// regions be written as transparent and deflate very well, at the cost
+	// of small visual differences. Since changes are measured from what is
+	// displayed rather than from the previous frame, the error never grows
+	// beyond the tolerance. A non-zero LossyTolerance implies DeltaFrames.
+	LossyTolerance uint8
+
+	// KeyframeInterval makes the encoder write keyframes, frames that cover
+	// the whole canvas with BLEND_OP_SOURCE, at the given interval, and list
+	// them in the APNG's Keyframes. A non-zero KeyframeInterval implies
+	// DeltaFrames.
+	KeyframeInterval KeyframeInterval
+
+	// MergeFrames collapses each run of consecutive frames that composite to
+	// the same canvas into one frame, whose delay is the sum of the run's
+	// delays. The merged animation is written as full-canvas frames, unless
+	// DeltaFrames is also set.
+	MergeFrames bool
+
+	// MergeTolerance is the largest difference, in 8-bit units, allowed in
+	// any channel of any pixel for MergeFrames to treat two frames as the
+	// same. Each frame is compared with the first frame of its run, so
+	// small changes can't add up across a long run.
+	MergeTolerance uint8
+
+	// Interlaced writes the default image and every frame using Adam7
+	// interlacing, so that viewers can show a progressive preview while the
+	// file is still loading. This usually makes the output slightly larger.
+	Interlaced bool
+
+	// Progress, if not nil, is called after each chunk is written and after
+	// each frame's image data is complete.
+	Progress func(Progress)
 }
 
 // CompressionWriter zlib compression writer interface.
@@ -62,11 +133,44 @@ type encoder struct {
 	tmp       [4 * 256]byte
 	cr        [nFilter][]uint8
 	pr        []uint8
+	chunk     []uint8
+	chunkSize int
 	zw        CompressionWriter
 	zwLevel   CompressionLevel
+	zwStrat   CompressionStrategy
 	bw        *bufio.Writer
+
+	// bf, bfLevel, bfCount and bfPrev are used by BruteForceFilter to
+	// measure the compressed size of each candidate row.
+	bf      *flate.Writer
+	bfLevel CompressionLevel
+	bfCount byteCounter
+	bfPrev  []uint8
+
+	// useTransparent and transparent are used for grayscale and truecolor
+	// transparency, as opposed to palette transparency.
+	useTransparent bool
+	transparent    [6]byte
+
+	// compressed optionally holds each frame's already compressed image
+	// data, in which case it is written as is.
+	compressed [][]byte
+	// pending compresses the image data of each frame in parallel when
+	// Encoder.Concurrency is more than 1.
+	pending *frameCompressor
+
+	// ctx is checked between chunks and rows through done, which is nil if
+	// ctx can never be done. progress is reported to Encoder.Progress.
+	ctx      context.Context
+	done     <-chan struct{}
+	progress Progress
 }
 
+// maxChunkData is the largest amount of image data that fits in an IDAT or
+// fdAT chunk. The PNG spec limits chunk lengths to 2^31-1 bytes, and an fdAT
+// chunk also holds a 4-byte sequence number.
+const maxChunkData = 1<<31 - 1 - 4
+
 // CompressionLevel indicates the compression level.
 type CompressionLevel int
 
@@ -76,15 +180,83 @@ const (
 	BestSpeed          CompressionLevel = -2
 	BestCompression    CompressionLevel = -3
 
-	// Positive CompressionLevel values are reserved to mean a numeric zlib
-	// compression level, although that is not implemented yet.
+	// Positive CompressionLevel values from 1 to 9 are numeric zlib
+	// compression levels, from fastest to smallest.
 )
 
+// CompressionStrategy indicates the compression strategy, as in zlib.
+type CompressionStrategy int
+
+const (
+	// DefaultStrategy uses the compress/zlib compressor.
+	DefaultStrategy CompressionStrategy = iota
+	// SmallestOfLevelAndHuffman compresses each frame twice, at the
+	// compression level and with Huffman coding only, and keeps the
+	// smaller, as the small values left by PNG row filters sometimes
+	// compress best without string matching. It is not zlib's Z_FILTERED.
+	// Each frame's filtered image data is held in memory, and compressing
+	// it twice takes about as long as both on their own.
+	SmallestOfLevelAndHuffman
+	// HuffmanOnlyStrategy only uses Huffman coding, without string matching.
+	HuffmanOnlyStrategy
+	// SmallestOfBestSpeedAndHuffman is SmallestOfLevelAndHuffman with
+	// BestSpeed in place of the compression level. It is not zlib's Z_RLE,
+	// but is also fast and suits images with large flat areas. It holds
+	// each frame's data in memory in the same way.
+	SmallestOfBestSpeedAndHuffman
+)
+
+// FilterStrategy indicates how the PNG row filter is chosen for each row.
+type FilterStrategy int
+
+const (
+	// DefaultFilter uses AdaptiveFilter, except for paletted images and
+	// NoCompression, where filtering is skipped.
+	DefaultFilter FilterStrategy = iota
+	// NoneFilter, SubFilter, UpFilter, AverageFilter and PaethFilter use
+	// that filter type for every row.
+	NoneFilter
+	SubFilter
+	UpFilter
+	AverageFilter
+	PaethFilter
+	// AdaptiveFilter picks, for each row, the filter that minimizes the sum
+	// of absolute differences, the same heuristic libpng uses.
+	AdaptiveFilter
+	// EntropyFilter picks, for each row, the filter whose output has the
+	// lowest Shannon entropy.
+	EntropyFilter
+	// BruteForceFilter picks, for each row, the filter whose output
+	// compresses the smallest, following the previous row. It is much
+	// slower than the heuristics.
+	BruteForceFilter
+)
+
+// KeyframeInterval sets how often an Encoder writes keyframes. The first
+// frame is always a keyframe, and after that a frame is one if either
+// interval has passed since the last keyframe. Zero fields are ignored.
+type KeyframeInterval struct {
+	// Frames is the number of frames from one keyframe to the next.
+	Frames int
+	// Duration is the time from the start of one keyframe to the next.
+	Duration time.Duration
+}
+
+// byteCounter is an io.Writer that only counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
 type opaquer interface {
 	Opaque() bool
 }
 
-// Returns whether or not the image is fully opaque.
+// Returns whether or not the image is fully opaque. The standard image types
+// all implement opaquer, which checks their pixels without a per-pixel At
+// call, or doesn't need to check them at all, as for Gray16, YCbCr and CMYK.
 func opaque(m image.Image) bool {
 	if o, ok := m.(opaquer); ok {
 		return o.Opaque()
@@ -101,6 +273,88 @@ func opaque(m image.Image) bool {
 	return true
 }
 
+// colorKey reports whether every pixel of every frame is either fully
+// opaque or fully transparent. If so, it returns a color that no opaque pixel
+// uses, so that the transparent pixels can be written as that color and
+// marked by a tRNS chunk instead of a full alpha channel. gray reports whether
+// the opaque pixels and the returned key are all shades of gray.
+func colorKey(frames []Frame) (key color.NRGBA, gray bool, ok bool) {
+	// Rule out partial transparency first, as most images with an alpha
+	// channel have some, before collecting the colors used.
+	if !eachPixel(frames, func(r, g, b uint8, a uint16) bool { return a == 0 || a == 0xffff }) {
+		return color.NRGBA{}, false, false
+	}
+	used := make(map[uint32]struct{})
+	gray = true
+	eachPixel(frames, func(r, g, b uint8, a uint16) bool {
+		if a != 0 {
+			used[uint32(r)<<16|uint32(g)<<8|uint32(b)] = struct{}{}
+			if r != g || g != b {
+				gray = false
+			}
+		}
+		return true
+	})
+	if gray {
+		for y := uint32(0); y < 256; y++ {
+			if _, ok := used[y*0x010101]; !ok {
+				return color.NRGBA{uint8(y), uint8(y), uint8(y), 0x00}, true, true
+			}
+		}
+		// Every shade of gray is taken, so fall back to a truecolor key.
+		gray = false
+	}
+	// At most len(used) colors are taken, so a free one is found within
+	// len(used)+1 tries.
+	for c := uint32(0); c < 1<<24; c++ {
+		if _, ok := used[c]; !ok {
+			return color.NRGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0x00}, false, true
+		}
+	}
+	return color.NRGBA{}, false, false
+}
+
+// eachPixel calls visit with the 8-bit color and 16-bit alpha of every pixel
+// of every frame, until it returns false. It reports whether visit returned
+// true for every pixel.
+func eachPixel(frames []Frame, visit func(r, g, b uint8, a uint16) bool) bool {
+	for _, f := range frames {
+		m := f.Image
+		b := m.Bounds()
+		switch m := m.(type) {
+		case *image.NRGBA, *image.RGBA:
+			// Both are 8-bit RGBA; an opaque pixel has the same bytes in
+			// either, and a transparent one is only checked for its alpha.
+			var pix []uint8
+			var stride int
+			if n, isNRGBA := m.(*image.NRGBA); isNRGBA {
+				pix, stride = n.Pix, n.Stride
+			} else {
+				r := m.(*image.RGBA)
+				pix, stride = r.Pix, r.Stride
+			}
+			for y := 0; y < b.Dy(); y++ {
+				row := pix[y*stride : y*stride+b.Dx()*4]
+				for j := 0; j < len(row); j += 4 {
+					if !visit(row[j+0], row[j+1], row[j+2], uint16(row[j+3])*0x101) {
+						return false
+					}
+				}
+			}
+		default:
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					r, g, b, a := m.At(x, y).RGBA()
+					if !visit(uint8(r>>8), uint8(g>>8), uint8(b>>8), uint16(a)) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
 // The absolute value of a byte interpreted as a signed int8.
 func abs8(d uint8) int {
 	if d < 128 {
@@ -113,6 +367,9 @@ func (e *encoder) writeChunk(b []byte, name string) {
 	if e.err != nil {
 		return
 	}
+	if e.err = e.canceled(); e.err != nil {
+		return
+	}
 	n := uint32(len(b))
 	if int(n) != len(b) {
 		e.err = UnsupportedError(name + " chunk is too large: " + strconv.Itoa(len(b)))
@@ -137,6 +394,11 @@ func (e *encoder) writeChunk(b []byte, name string) {
 		return
 	}
 	_, e.err = e.w.Write(e.footer[:4])
+	if e.err != nil {
+		return
+	}
+	e.progress.Bytes += int64(len(b)) + 12
+	e.report()
 }
 
 func (e *encoder) writeIHDR() {
@@ -178,16 +440,60 @@ func (e *encoder) writeIHDR() {
 	}
 	e.tmp[10] = 0 // default compression method
 	e.tmp[11] = 0 // default filter method
-	e.tmp[12] = 0 // non-interlaced
+	if e.enc.Interlaced {
+		e.tmp[12] = itAdam7
+	} else {
+		e.tmp[12] = itNone
+	}
 	e.writeChunk(e.tmp[:13], "IHDR")
 }
 
+// numFrames returns the number of frames of the animation a, which doesn't
+// include a default image.
+func numFrames(a APNG) int {
+	if a.Frames[0].IsDefault {
+		return len(a.Frames) - 1
+	}
+	return len(a.Frames)
+}
+
 func (e *encoder) writeacTL() {
-	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(len(e.a.Frames)))
+	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(numFrames(e.a)))
 	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(e.a.LoopCount))
 	e.writeChunk(e.tmp[:8], "acTL")
 }
 
+// checkKeyframes returns an error if any of a's Keyframes is not the index
+// of a frame with an fcTL chunk that covers the whole canvas with
+// BLEND_OP_SOURCE, as a player seeking to it would show the wrong image.
+func checkKeyframes(a APNG) error {
+	canvas := a.Frames[0].Image.Bounds().Size()
+	for _, k := range a.Keyframes {
+		if k < 0 || k >= len(a.Frames) || a.Frames[k].IsDefault {
+			return FormatError("keyframe " + strconv.Itoa(k) + " is not an animation frame")
+		}
+		f := a.Frames[k]
+		if f.XOffset != 0 || f.YOffset != 0 || f.Image.Bounds().Size() != canvas || f.BlendOp != BLEND_OP_SOURCE {
+			return FormatError("keyframe " + strconv.Itoa(k) + " does not cover the canvas with BLEND_OP_SOURCE")
+		}
+	}
+	return nil
+}
+
+// writekfIX writes the private kfIX chunk, which lists the keyframes as
+// 4-byte frame numbers, counting from the first frame with an fcTL chunk.
+func (e *encoder) writekfIX() {
+	first := 0
+	if e.a.Frames[0].IsDefault {
+		first = 1
+	}
+	b := make([]byte, 4*len(e.a.Keyframes))
+	for i, k := range e.a.Keyframes {
+		binary.BigEndian.PutUint32(b[4*i:], uint32(k-first))
+	}
+	e.writeChunk(b, "kfIX")
+}
+
 func (e *encoder) writefcTL(f Frame) {
 	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(e.seq))
 	e.seq = e.seq + 1
@@ -203,21 +509,52 @@ func (e *encoder) writefcTL(f Frame) {
 	e.writeChunk(e.tmp[:26], "fcTL")
 }
 
-func (e *encoder) writefdATs(f Frame) {
+func (e *encoder) writefdATs(i int) {
 	e.writeType = 1
+	e.writeFrameData(i)
+}
+
+// writeFrameData writes the image data of frame i to one or more chunks of
+// the current writeType.
+func (e *encoder) writeFrameData(i int) {
 	if e.err != nil {
 		return
 	}
+	defer e.frameDone(i)
+	if e.compressed != nil {
+		e.Write(e.compressed[i])
+		e.flushChunk()
+		return
+	}
+	if e.pending != nil {
+		var data []byte
+		if data, e.err = e.pending.wait(i); e.err != nil {
+			return
+		}
+		e.Write(data)
+		e.flushChunk()
+		return
+	}
 	if e.bw == nil {
 		e.bw = bufio.NewWriterSize(e, 1<<15)
 	} else {
 		e.bw.Reset(e)
 	}
-	e.err = e.writeImage(e.bw, f.Image, e.cb, e.enc.CompressionLevel)
+	e.err = e.writeImage(e.bw, e.a.Frames[i].Image, e.cb, e.enc.CompressionLevel)
 	if e.err != nil {
 		return
 	}
 	e.err = e.bw.Flush()
+	e.flushChunk()
+}
+
+// frameDone reports that the image data of frame i has been written, unless
+// writing it failed.
+func (e *encoder) frameDone(i int) {
+	if e.err == nil && !e.a.Frames[i].IsDefault {
+		e.progress.Frames++
+		e.report()
+	}
 }
 
 func (e *encoder) writePLTEAndTRNS(p color.Palette) {
@@ -242,26 +579,61 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 	}
 }
 
-// An encoder is an io.Writer that satisfies writes by writing PNG IDAT chunks,
-// including an 8-byte header and 4-byte CRC checksum per Write call. Such calls
-// should be relatively infrequent, since writeIDATs uses a bufio.Writer.
+// writeTRNS writes the color key used for grayscale and truecolor
+// transparency.
+func (e *encoder) writeTRNS() {
+	switch e.cb {
+	case cbG8:
+		e.writeChunk(e.transparent[:2], "tRNS")
+	case cbTC8:
+		e.writeChunk(e.transparent[:6], "tRNS")
+	}
+}
+
+// An encoder is an io.Writer that satisfies writes by writing PNG IDAT or
+// fdAT chunks of up to chunkSize bytes of data each, including an 8-byte
+// header and 4-byte CRC checksum per chunk. The data of a partial chunk is
+// held until flushChunk is called.
 //
-// This method should only be called from writeIDATs (via writeImage).
+// This method should only be called from writeFrameData (via writeImage).
 // No other code should treat an encoder as an io.Writer.
 func (e *encoder) Write(b []byte) (int, error) {
-	if e.writeType == 0 {
-		e.writeChunk(b, "IDAT")
-	} else {
-		c := make([]byte, 4)
-		binary.BigEndian.PutUint32(c[0:4], uint32(e.seq))
-		e.seq = e.seq + 1
-		b = append(c, b...)
-		e.writeChunk(b, "fdAT")
+	n := len(b)
+	for len(b) > 0 && e.err == nil {
+		// An fdAT chunk starts with a sequence number, filled in later.
+		header := 4 * e.writeType
+		if len(e.chunk) == 0 {
+			e.chunk = append(e.chunk, make([]uint8, header)...)
+		}
+		room := e.chunkSize + header - len(e.chunk)
+		if room > len(b) {
+			room = len(b)
+		}
+		e.chunk = append(e.chunk, b[:room]...)
+		b = b[room:]
+		if len(e.chunk) == e.chunkSize+header {
+			e.flushChunk()
+		}
 	}
 	if e.err != nil {
 		return 0, e.err
 	}
-	return len(b), nil
+	return n, nil
+}
+
+// flushChunk writes any held image data as an IDAT or fdAT chunk.
+func (e *encoder) flushChunk() {
+	if len(e.chunk) == 0 {
+		return
+	}
+	if e.writeType == 0 {
+		e.writeChunk(e.chunk, "IDAT")
+	} else {
+		binary.BigEndian.PutUint32(e.chunk[0:4], uint32(e.seq))
+		e.seq = e.seq + 1
+		e.writeChunk(e.chunk, "fdAT")
+	}
+	e.chunk = e.chunk[:0]
 }
 
 // Chooses the filter to use for encoding the current row, and applies it.
@@ -357,6 +729,120 @@ func filter(cr *[nFilter][]byte, pr []byte, bpp int) int {
 	return filter
 }
 
+// applyFilters applies every filter type to the current row, storing the
+// results in the corresponding rows of cr.
+func applyFilters(cr *[nFilter][]byte, pr []byte, bpp int) {
+	cdat0 := cr[0][1:]
+	cdat1 := cr[1][1:]
+	cdat2 := cr[2][1:]
+	cdat3 := cr[3][1:]
+	cdat4 := cr[4][1:]
+	pdat := pr[1:]
+	n := len(cdat0)
+	if bpp > n {
+		bpp = n
+	}
+
+	for i := 0; i < bpp; i++ {
+		cdat1[i] = cdat0[i]
+		cdat2[i] = cdat0[i] - pdat[i]
+		cdat3[i] = cdat0[i] - pdat[i]/2
+		cdat4[i] = cdat0[i] - pdat[i]
+	}
+	for i := bpp; i < n; i++ {
+		cdat1[i] = cdat0[i] - cdat0[i-bpp]
+		cdat2[i] = cdat0[i] - pdat[i]
+		cdat3[i] = cdat0[i] - uint8((int(cdat0[i-bpp])+int(pdat[i]))/2)
+		cdat4[i] = cdat0[i] - paeth(cdat0[i-bpp], pdat[i], pdat[i-bpp])
+	}
+}
+
+// filterEntropy applies every filter type to the current row and returns the
+// one whose bytes have the lowest Shannon entropy.
+func filterEntropy(cr *[nFilter][]byte, pr []byte, bpp int) int {
+	applyFilters(cr, pr, bpp)
+	best, bestEntropy := ftNone, math.Inf(1)
+	for ft := 0; ft < nFilter; ft++ {
+		var hist [256]int
+		for _, b := range cr[ft][1:] {
+			hist[b]++
+		}
+		n := float64(len(cr[ft]) - 1)
+		entropy := 0.0
+		for _, c := range hist {
+			if c != 0 {
+				p := float64(c) / n
+				entropy -= p * math.Log2(p)
+			}
+		}
+		if entropy < bestEntropy {
+			best, bestEntropy = ft, entropy
+		}
+	}
+	return best
+}
+
+// filterBruteForce applies every filter type to the current row and returns
+// the one that compresses the smallest when following the previously chosen
+// row.
+func (e *encoder) filterBruteForce(cr *[nFilter][]byte, pr []byte, bpp int, level CompressionLevel) (int, error) {
+	if e.bf == nil || e.bfLevel != level {
+		l := levelToZlib(level)
+		if l < flate.DefaultCompression || l > flate.BestCompression {
+			l = flate.DefaultCompression
+		}
+		bf, err := flate.NewWriter(&e.bfCount, l)
+		if err != nil {
+			return ftNone, err
+		}
+		e.bf, e.bfLevel = bf, level
+	}
+	applyFilters(cr, pr, bpp)
+	best, bestSize := ftNone, byteCounter(-1)
+	for ft := 0; ft < nFilter; ft++ {
+		e.bfCount = 0
+		e.bf.Reset(&e.bfCount)
+		e.bf.Write(e.bfPrev)
+		e.bf.Write(cr[ft])
+		if err := e.bf.Flush(); err != nil {
+			return ftNone, err
+		}
+		if bestSize < 0 || e.bfCount < bestSize {
+			best, bestSize = ft, e.bfCount
+		}
+	}
+	e.bfPrev = append(e.bfPrev[:0], cr[best]...)
+	return best, nil
+}
+
+// filterRow applies the Encoder's FilterStrategy to the current row. The
+// return value is the index of the filter and also of the row in cr that has
+// had it applied.
+func (e *encoder) filterRow(cr *[nFilter][]byte, pr []byte, bpp int, cb int, level CompressionLevel) (int, error) {
+	switch s := e.enc.FilterStrategy; s {
+	case DefaultFilter:
+		// Skip filter for NoCompression and paletted images as "filters are
+		// rarely useful on palette images" and will result in larger files
+		// (see http://www.libpng.org/pub/png/book/chapter09.html).
+		if level == NoCompression || cbPaletted(cb) {
+			return ftNone, nil
+		}
+		return filter(cr, pr, bpp), nil
+	case NoneFilter:
+		return ftNone, nil
+	case SubFilter, UpFilter, AverageFilter, PaethFilter:
+		applyFilters(cr, pr, bpp)
+		return int(s - NoneFilter), nil
+	case AdaptiveFilter:
+		return filter(cr, pr, bpp), nil
+	case EntropyFilter:
+		return filterEntropy(cr, pr, bpp), nil
+	case BruteForceFilter:
+		return e.filterBruteForce(cr, pr, bpp, level)
+	}
+	return ftNone, FormatError("invalid filter strategy: " + strconv.Itoa(int(e.enc.FilterStrategy)))
+}
+
 func zeroMemory(v []uint8) {
 	for i := range v {
 		v[i] = 0
@@ -364,7 +850,7 @@ func zeroMemory(v []uint8) {
 }
 
 func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level CompressionLevel) error {
-	if e.zw == nil || e.zwLevel != level {
+	if e.zw == nil || e.zwLevel != level || e.zwStrat != e.enc.CompressionStrategy {
 		if e.enc.CompressionWriter != nil {
 			zw, err := e.enc.CompressionWriter(w)
 			if err != nil {
@@ -372,18 +858,35 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 			}
 			e.zw = zw
 		} else {
-			zw, err := zlib.NewWriterLevel(w, levelToZlib(level))
+			zw, err := newCompressionWriter(w, level, e.enc.CompressionStrategy)
 			if err != nil {
 				return err
 			}
 			e.zw = zw
 		}
 		e.zwLevel = level
+		e.zwStrat = e.enc.CompressionStrategy
 	} else {
 		e.zw.Reset(w)
 	}
 	defer e.zw.Close()
 
+	if e.enc.Interlaced {
+		for pass := 0; pass < 7; pass++ {
+			if p := interlacePass(m, pass); p != nil {
+				if err := e.writePass(p, cb, level); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return e.writePass(m, cb, level)
+}
+
+// writePass filters and compresses the rows of m, which is either the whole
+// image or a single Adam7 pass of it.
+func (e *encoder) writePass(m image.Image, cb int, level CompressionLevel) error {
 	bitsPerPixel := 0
 
 	switch cb {
@@ -432,13 +935,27 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 		zeroMemory(e.pr)
 	}
 	pr := e.pr
+	e.bfPrev = e.bfPrev[:0]
+
+	// Filters work on whole bytes, so pixels smaller than a byte are
+	// filtered as if they were one byte, as per the PNG spec.
+	bpp := (bitsPerPixel + 7) / 8
 
 	gray, _ := m.(*image.Gray)
 	rgba, _ := m.(*image.RGBA)
 	paletted, _ := m.(*image.Paletted)
 	nrgba, _ := m.(*image.NRGBA)
+	gray16, _ := m.(*image.Gray16)
+	rgba64, _ := m.(*image.RGBA64)
+	nrgba64, _ := m.(*image.NRGBA64)
+	ycbcr, _ := m.(*image.YCbCr)
+	cmyk, _ := m.(*image.CMYK)
 
 	for y := b.Min.Y; y < b.Max.Y; y++ {
+		if err := e.canceled(); err != nil {
+			return err
+		}
+
 		// Convert from colors to bytes.
 		i := 1
 		switch cb {
@@ -448,13 +965,18 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 				copy(cr[0][1:], gray.Pix[offset:offset+b.Dx()])
 			} else {
 				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
-					cr[0][i] = c.Y
+					c := m.At(x, y)
+					if _, _, _, a := c.RGBA(); e.useTransparent && a == 0 {
+						cr[0][i] = e.transparent[1]
+					} else {
+						cr[0][i] = color.GrayModel.Convert(c).(color.Gray).Y
+					}
 					i++
 				}
 			}
 		case cbTC8:
-			// We have previously verified that the alpha value is fully opaque.
+			// We have previously verified that the alpha value is fully opaque,
+			// or fully transparent when a color key is in use.
 			cr0 := cr[0]
 			stride, pix := 0, []byte(nil)
 			if rgba != nil {
@@ -466,17 +988,29 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 				j0 := (y - b.Min.Y) * stride
 				j1 := j0 + b.Dx()*4
 				for j := j0; j < j1; j += 4 {
-					cr0[i+0] = pix[j+0]
-					cr0[i+1] = pix[j+1]
-					cr0[i+2] = pix[j+2]
+					if e.useTransparent && pix[j+3] == 0 {
+						cr0[i+0] = e.transparent[1]
+						cr0[i+1] = e.transparent[3]
+						cr0[i+2] = e.transparent[5]
+					} else {
+						cr0[i+0] = pix[j+0]
+						cr0[i+1] = pix[j+1]
+						cr0[i+2] = pix[j+2]
+					}
 					i += 3
 				}
 			} else {
 				for x := b.Min.X; x < b.Max.X; x++ {
-					r, g, b, _ := m.At(x, y).RGBA()
-					cr0[i+0] = uint8(r >> 8)
-					cr0[i+1] = uint8(g >> 8)
-					cr0[i+2] = uint8(b >> 8)
+					r, g, b, a := m.At(x, y).RGBA()
+					if e.useTransparent && a == 0 {
+						cr0[i+0] = e.transparent[1]
+						cr0[i+1] = e.transparent[3]
+						cr0[i+2] = e.transparent[5]
+					} else {
+						cr0[i+0] = uint8(r >> 8)
+						cr0[i+1] = uint8(g >> 8)
+						cr0[i+2] = uint8(b >> 8)
+					}
 					i += 3
 				}
 			}
@@ -532,50 +1066,129 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 				}
 			}
 		case cbG16:
-			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
-				cr[0][i+0] = uint8(c.Y >> 8)
-				cr[0][i+1] = uint8(c.Y)
-				i += 2
+			if gray16 != nil {
+				offset := (y - b.Min.Y) * gray16.Stride
+				copy(cr[0][1:], gray16.Pix[offset:offset+b.Dx()*2])
+			} else {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
+					cr[0][i+0] = uint8(c.Y >> 8)
+					cr[0][i+1] = uint8(c.Y)
+					i += 2
+				}
 			}
 		case cbTC16:
 			// We have previously verified that the alpha value is fully opaque.
-			for x := b.Min.X; x < b.Max.X; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				cr[0][i+0] = uint8(r >> 8)
-				cr[0][i+1] = uint8(r)
-				cr[0][i+2] = uint8(g >> 8)
-				cr[0][i+3] = uint8(g)
-				cr[0][i+4] = uint8(b >> 8)
-				cr[0][i+5] = uint8(b)
-				i += 6
+			cr0 := cr[0]
+			stride, pix := 0, []byte(nil)
+			if rgba64 != nil {
+				stride, pix = rgba64.Stride, rgba64.Pix
+			} else if nrgba64 != nil {
+				stride, pix = nrgba64.Stride, nrgba64.Pix
+			}
+			switch {
+			case stride != 0:
+				// Opaque RGBA64 and NRGBA64 pixels have the same bytes.
+				j0 := (y - b.Min.Y) * stride
+				j1 := j0 + b.Dx()*8
+				for j := j0; j < j1; j += 8 {
+					copy(cr0[i:i+6], pix[j:j+6])
+					i += 6
+				}
+			case ycbcr != nil:
+				for x := b.Min.X; x < b.Max.X; x++ {
+					yi, ci := ycbcr.YOffset(x, y), ycbcr.COffset(x, y)
+					r, g, b, _ := color.YCbCr{ycbcr.Y[yi], ycbcr.Cb[ci], ycbcr.Cr[ci]}.RGBA()
+					cr0[i+0] = uint8(r >> 8)
+					cr0[i+1] = uint8(r)
+					cr0[i+2] = uint8(g >> 8)
+					cr0[i+3] = uint8(g)
+					cr0[i+4] = uint8(b >> 8)
+					cr0[i+5] = uint8(b)
+					i += 6
+				}
+			case cmyk != nil:
+				j0 := (y - b.Min.Y) * cmyk.Stride
+				j1 := j0 + b.Dx()*4
+				for j := j0; j < j1; j += 4 {
+					r, g, b, _ := color.CMYK{cmyk.Pix[j], cmyk.Pix[j+1], cmyk.Pix[j+2], cmyk.Pix[j+3]}.RGBA()
+					cr0[i+0] = uint8(r >> 8)
+					cr0[i+1] = uint8(r)
+					cr0[i+2] = uint8(g >> 8)
+					cr0[i+3] = uint8(g)
+					cr0[i+4] = uint8(b >> 8)
+					cr0[i+5] = uint8(b)
+					i += 6
+				}
+			default:
+				for x := b.Min.X; x < b.Max.X; x++ {
+					r, g, b, _ := m.At(x, y).RGBA()
+					cr0[i+0] = uint8(r >> 8)
+					cr0[i+1] = uint8(r)
+					cr0[i+2] = uint8(g >> 8)
+					cr0[i+3] = uint8(g)
+					cr0[i+4] = uint8(b >> 8)
+					cr0[i+5] = uint8(b)
+					i += 6
+				}
 			}
 		case cbTCA16:
-			// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
-			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
-				cr[0][i+0] = uint8(c.R >> 8)
-				cr[0][i+1] = uint8(c.R)
-				cr[0][i+2] = uint8(c.G >> 8)
-				cr[0][i+3] = uint8(c.G)
-				cr[0][i+4] = uint8(c.B >> 8)
-				cr[0][i+5] = uint8(c.B)
-				cr[0][i+6] = uint8(c.A >> 8)
-				cr[0][i+7] = uint8(c.A)
-				i += 8
+			cr0 := cr[0]
+			if nrgba64 != nil {
+				offset := (y - b.Min.Y) * nrgba64.Stride
+				copy(cr0[1:], nrgba64.Pix[offset:offset+b.Dx()*8])
+			} else if rgba64 != nil {
+				// Convert from alpha-premultiplied to PNG's non-alpha-premultiplied,
+				// as color.NRGBA64Model does.
+				j0 := (y - b.Min.Y) * rgba64.Stride
+				j1 := j0 + b.Dx()*8
+				for j := j0; j < j1; j += 8 {
+					pix := rgba64.Pix[j : j+8 : j+8]
+					a := uint32(pix[6])<<8 | uint32(pix[7])
+					switch a {
+					case 0xffff:
+						copy(cr0[i:i+8], pix)
+					case 0:
+						zeroMemory(cr0[i : i+8])
+					default:
+						r := uint32(pix[0])<<8 | uint32(pix[1])
+						g := uint32(pix[2])<<8 | uint32(pix[3])
+						b := uint32(pix[4])<<8 | uint32(pix[5])
+						r = (r * 0xffff) / a
+						g = (g * 0xffff) / a
+						b = (b * 0xffff) / a
+						cr0[i+0] = uint8(r >> 8)
+						cr0[i+1] = uint8(r)
+						cr0[i+2] = uint8(g >> 8)
+						cr0[i+3] = uint8(g)
+						cr0[i+4] = uint8(b >> 8)
+						cr0[i+5] = uint8(b)
+						cr0[i+6] = pix[6]
+						cr0[i+7] = pix[7]
+					}
+					i += 8
+				}
+			} else {
+				// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
+				for x := b.Min.X; x < b.Max.X; x++ {
+					c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+					cr0[i+0] = uint8(c.R >> 8)
+					cr0[i+1] = uint8(c.R)
+					cr0[i+2] = uint8(c.G >> 8)
+					cr0[i+3] = uint8(c.G)
+					cr0[i+4] = uint8(c.B >> 8)
+					cr0[i+5] = uint8(c.B)
+					cr0[i+6] = uint8(c.A >> 8)
+					cr0[i+7] = uint8(c.A)
+					i += 8
+				}
 			}
 		}
 
 		// Apply the filter.
-		// Skip filter for NoCompression and paletted images (cbP8) as
-		// "filters are rarely useful on palette images" and will result
-		// in larger files (see http://www.libpng.org/pub/png/book/chapter09.html).
-		f := ftNone
-		if level != zlib.NoCompression && cb != cbP8 && cb != cbP4 && cb != cbP2 && cb != cbP1 {
-			// Since we skip paletted images we don't have to worry about
-			// bitsPerPixel not being a multiple of 8
-			bpp := bitsPerPixel / 8
-			f = filter(&cr, pr, bpp)
+		f, err := e.filterRow(&cr, pr, bpp, cb, level)
+		if err != nil {
+			return err
 		}
 
 		// Write the compressed bytes.
@@ -589,27 +1202,207 @@ func (e *encoder) writeImage(w io.Writer, m image.Image, cb int, level Compressi
 	return nil
 }
 
+// interlacePass returns the pixels of m that belong to the given Adam7 pass,
+// as an image of the same type where possible, or nil if the pass is empty.
+// It is the inverse of the decoder's mergePassInto.
+func interlacePass(m image.Image, pass int) image.Image {
+	p := interlacing[pass]
+	b := m.Bounds()
+	// Add the multiplication factor and subtract one, effectively rounding up.
+	width := (b.Dx() - p.xOffset + p.xFactor - 1) / p.xFactor
+	height := (b.Dy() - p.yOffset + p.yFactor - 1) / p.yFactor
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	rect := image.Rect(0, 0, width, height)
+	var (
+		srcPix        []uint8
+		dstPix        []uint8
+		srcStride     int
+		dstStride     int
+		bytesPerPixel int
+		dst           image.Image
+	)
+	switch source := m.(type) {
+	case *image.Alpha:
+		target := image.NewAlpha(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 1
+	case *image.Alpha16:
+		target := image.NewAlpha16(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 2
+	case *image.CMYK:
+		target := image.NewCMYK(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 4
+	case *image.Gray:
+		target := image.NewGray(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 1
+	case *image.Gray16:
+		target := image.NewGray16(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 2
+	case *image.NRGBA:
+		target := image.NewNRGBA(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 4
+	case *image.NRGBA64:
+		target := image.NewNRGBA64(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 8
+	case *image.Paletted:
+		target := image.NewPaletted(rect, source.Palette)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 1
+	case *image.RGBA:
+		target := image.NewRGBA(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 4
+	case *image.RGBA64:
+		target := image.NewRGBA64(rect)
+		srcPix, srcStride = source.Pix, source.Stride
+		dstPix, dstStride, dst = target.Pix, target.Stride, target
+		bytesPerPixel = 8
+	default:
+		// Other image types are copied pixel by pixel, keeping color indexes
+		// for paletted images and full 16-bit precision otherwise.
+		if pi, ok := m.(image.PalettedImage); ok {
+			if pal, ok := m.ColorModel().(color.Palette); ok {
+				target := image.NewPaletted(rect, pal)
+				for y := 0; y < height; y++ {
+					for x := 0; x < width; x++ {
+						target.SetColorIndex(x, y, pi.ColorIndexAt(b.Min.X+x*p.xFactor+p.xOffset, b.Min.Y+y*p.yFactor+p.yOffset))
+					}
+				}
+				return target
+			}
+		}
+		target := image.NewRGBA64(rect)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				target.Set(x, y, m.At(b.Min.X+x*p.xFactor+p.xOffset, b.Min.Y+y*p.yFactor+p.yOffset))
+			}
+		}
+		return target
+	}
+	d := 0
+	for y := 0; y < height; y++ {
+		s := (y*p.yFactor+p.yOffset)*srcStride + p.xOffset*bytesPerPixel
+		for x := 0; x < width; x++ {
+			copy(dstPix[d+x*bytesPerPixel:], srcPix[s:s+bytesPerPixel])
+			s += p.xFactor * bytesPerPixel
+		}
+		d += dstStride
+	}
+	return dst
+}
+
 // Write the actual image data to one or more IDAT chunks.
 func (e *encoder) writeIDATs() {
 	e.writeType = 0
-	if e.err != nil {
-		return
+	e.writeFrameData(0)
+}
+
+// newCompressionWriter returns the built-in zlib writer for the given level
+// and strategy, which must be valid as per checkCompression.
+func newCompressionWriter(w io.Writer, level CompressionLevel, strategy CompressionStrategy) (CompressionWriter, error) {
+	l := levelToZlib(level)
+	if l == zlib.NoCompression {
+		return zlib.NewWriterLevel(w, l)
 	}
-	if e.bw == nil {
-		e.bw = bufio.NewWriterSize(e, 1<<15)
-	} else {
-		e.bw.Reset(e)
+	switch strategy {
+	case SmallestOfLevelAndHuffman:
+		return newSmallestWriter(w, l, zlib.HuffmanOnly)
+	case SmallestOfBestSpeedAndHuffman:
+		return newSmallestWriter(w, zlib.BestSpeed, zlib.HuffmanOnly)
+	case HuffmanOnlyStrategy:
+		return zlib.NewWriterLevel(w, zlib.HuffmanOnly)
 	}
-	e.err = e.writeImage(e.bw, e.a.Frames[0].Image, e.cb, e.enc.CompressionLevel)
-	if e.err != nil {
-		return
+	return zlib.NewWriterLevel(w, l)
+}
+
+// checkCompression returns an error if the Encoder's CompressionLevel or
+// CompressionStrategy is invalid, so that it is reported before anything is
+// written.
+func (enc *Encoder) checkCompression() error {
+	if enc.CompressionWriter != nil {
+		return nil
 	}
-	e.err = e.bw.Flush()
+	if enc.CompressionLevel > 9 {
+		return FormatError("invalid compression level: " + strconv.Itoa(int(enc.CompressionLevel)))
+	}
+	if enc.CompressionStrategy < DefaultStrategy || enc.CompressionStrategy > SmallestOfBestSpeedAndHuffman {
+		return FormatError("invalid compression strategy: " + strconv.Itoa(int(enc.CompressionStrategy)))
+	}
+	return nil
+}
+
+// smallestWriter is a CompressionWriter that compresses the data written to
+// it with zlib at each of several levels, and writes the smallest result
+// when closed. The data is held in memory until then.
+type smallestWriter struct {
+	w    io.Writer
+	data bytes.Buffer
+	zw   []*zlib.Writer
+	out  []bytes.Buffer
+}
+
+func newSmallestWriter(w io.Writer, levels ...int) (*smallestWriter, error) {
+	z := &smallestWriter{w: w, zw: make([]*zlib.Writer, len(levels)), out: make([]bytes.Buffer, len(levels))}
+	for i, l := range levels {
+		zw, err := zlib.NewWriterLevel(&z.out[i], l)
+		if err != nil {
+			return nil, err
+		}
+		z.zw[i] = zw
+	}
+	return z, nil
+}
+
+func (z *smallestWriter) Write(p []byte) (int, error) {
+	return z.data.Write(p)
+}
+
+func (z *smallestWriter) Close() error {
+	best := -1
+	for i, zw := range z.zw {
+		z.out[i].Reset()
+		zw.Reset(&z.out[i])
+		zw.Write(z.data.Bytes())
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if best < 0 || z.out[i].Len() < z.out[best].Len() {
+			best = i
+		}
+	}
+	_, err := z.w.Write(z.out[best].Bytes())
+	return err
+}
+
+func (z *smallestWriter) Reset(w io.Writer) {
+	z.w = w
+	z.data.Reset()
 }
 
 // This function is required because we want the zero value of
 // Encoder.CompressionLevel to map to zlib.DefaultCompression.
 func levelToZlib(l CompressionLevel) int {
+	if l > 0 {
+		// Values above 9 are rejected by checkCompression.
+		return int(l)
+	}
 	switch l {
 	case DefaultCompression:
 		return zlib.DefaultCompression
@@ -624,41 +1417,11 @@ func levelToZlib(l CompressionLevel) int {
 	}
 }
 
-func (e *encoder) writeIEND() { e.writeChunk(nil, "IEND") }
-
-// Encode writes the APNG a to w in PNG format. Any Image may be
-// encoded, but images that are not image.NRGBA might be encoded lossily.
-func Encode(w io.Writer, a APNG) error {
-	var e Encoder
-	return e.Encode(w, a)
-}
-
-// Encode writes the Animation a to w in PNG format.
-func (enc *Encoder) Encode(w io.Writer, a APNG) error {
-	// Obviously, negative widths and heights are invalid. Furthermore, the PNG
-	// spec section 11.2.2 says that zero is invalid. Excessively large images are
-	// also rejected.
-	mw, mh := int64(a.Frames[0].Image.Bounds().Dx()), int64(a.Frames[0].Image.Bounds().Dy())
-	if mw <= 0 || mh <= 0 || mw >= 1<<32 || mh >= 1<<32 {
-		return FormatError("invalid image size: " + strconv.FormatInt(mw, 10) + "x" + strconv.FormatInt(mh, 10))
-	}
-
-	var e *encoder
-	if enc.BufferPool != nil {
-		buffer := enc.BufferPool.Get()
-		e = (*encoder)(buffer)
-
-	}
-	if e == nil {
-		e = &encoder{}
-	}
-	if enc.BufferPool != nil {
-		defer enc.BufferPool.Put((*EncoderBuffer)(e))
-	}
-
-	e.enc = enc
-	e.w = w
-	e.a = a
+// setColorType chooses the color type and bit depth for e.a, and returns
+// the palette to write, if any.
+func (e *encoder) setColorType() color.Palette {
+	a := e.a
+	e.useTransparent = false
 
 	var pal color.Palette
 	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
@@ -691,6 +1454,16 @@ func (enc *Encoder) Encode(w io.Writer, a APNG) error {
 			}
 			if isOpaque {
 				e.cb = cbTC8
+			} else if key, gray, ok := colorKey(a.Frames); ok {
+				// Every pixel is either opaque or fully transparent, so
+				// a tRNS color key can replace the alpha channel.
+				if gray {
+					e.cb = cbG8
+				} else {
+					e.cb = cbTC8
+				}
+				e.useTransparent = true
+				e.transparent = [6]byte{0, key.R, 0, key.G, 0, key.B}
 			} else {
 				e.cb = cbTCA8
 			}
@@ -709,14 +1482,122 @@ func (enc *Encoder) Encode(w io.Writer, a APNG) error {
 			}
 		}
 	}
+	return pal
+}
+
+func (e *encoder) writeIEND() { e.writeChunk(nil, "IEND") }
+
+// Encode writes the APNG a to w in PNG format. Any Image may be
+// encoded, but images that are not image.NRGBA might be encoded lossily.
+func Encode(w io.Writer, a APNG) error {
+	var e Encoder
+	return e.Encode(w, a)
+}
+
+// deltaEncoding reports whether enc writes frames as deltas, as set by
+// DeltaFrames or implied by other options.
+func (enc *Encoder) deltaEncoding() bool {
+	return enc.DeltaFrames || enc.LossyTolerance > 0 || enc.KeyframeInterval != KeyframeInterval{}
+}
 
+// Encode writes the Animation a to w in PNG format.
+func (enc *Encoder) Encode(w io.Writer, a APNG) error {
+	return enc.EncodeContext(context.Background(), w, a)
+}
+
+// EncodeContext writes the Animation a to w in PNG format, like Encode, but
+// returns ctx.Err() as soon as ctx is done. It is checked between frames
+// while preparing them for MergeFrames and DeltaFrames, and between chunks
+// and rows while writing.
+func (enc *Encoder) EncodeContext(ctx context.Context, w io.Writer, a APNG) error {
+	var err error
+	if enc.MergeFrames {
+		if a, err = enc.mergeFrames(ctx, a); err != nil {
+			return err
+		}
+	}
+	if enc.deltaEncoding() {
+		if a, err = enc.deltaFrames(ctx, a); err != nil {
+			return err
+		}
+	}
+	return enc.encode(ctx, w, a, nil)
+}
+
+// encode writes a to w, using the already compressed image data of each
+// frame if compressed is not nil.
+func (enc *Encoder) encode(ctx context.Context, w io.Writer, a APNG, compressed [][]byte) error {
+	// Obviously, negative widths and heights are invalid. Furthermore, the PNG
+	// spec section 11.2.2 says that zero is invalid. Excessively large images are
+	// also rejected.
+	mw, mh := int64(a.Frames[0].Image.Bounds().Dx()), int64(a.Frames[0].Image.Bounds().Dy())
+	if mw <= 0 || mh <= 0 || mw >= 1<<32 || mh >= 1<<32 {
+		return FormatError("invalid image size: " + strconv.FormatInt(mw, 10) + "x" + strconv.FormatInt(mh, 10))
+	}
+	if err := enc.checkCompression(); err != nil {
+		return err
+	}
+	if err := checkKeyframes(a); err != nil {
+		return err
+	}
+
+	var e *encoder
+	if enc.BufferPool != nil {
+		buffer := enc.BufferPool.Get()
+		e = (*encoder)(buffer)
+
+	}
+	if e == nil {
+		e = &encoder{}
+	}
+	if enc.BufferPool != nil {
+		defer enc.BufferPool.Put((*EncoderBuffer)(e))
+	}
+
+	e.enc = enc
+	e.w = w
+	e.a = a
+	e.seq = 0
+	e.chunk = e.chunk[:0]
+	e.chunkSize = enc.ChunkSize
+	if e.chunkSize <= 0 {
+		e.chunkSize = 1 << 15
+	} else if e.chunkSize > maxChunkData {
+		e.chunkSize = maxChunkData
+	}
+	e.compressed = compressed
+	e.ctx = ctx
+	e.done = ctx.Done()
+	// Don't hold on to ctx in the pool.
+	defer func() { e.ctx, e.done = nil, nil }()
+	e.progress = Progress{}
+	if len(a.Frames) > 1 {
+		e.progress.TotalFrames = numFrames(a)
+	}
+
+	pal := e.setColorType()
+	e.pending = nil
+	if compressed == nil && enc.Concurrency > 1 && len(a.Frames) > 1 {
+		e.pending = e.startCompression(enc.Concurrency)
+		defer e.pending.stop()
+	}
+
+	if e.err = ctx.Err(); e.err != nil {
+		return e.err
+	}
 	_, e.err = io.WriteString(w, pngHeader)
+	e.progress.Bytes = int64(len(pngHeader))
 	e.writeIHDR()
 	if pal != nil {
 		e.writePLTEAndTRNS(pal)
+	} else if e.useTransparent {
+		e.writeTRNS()
 	}
 	if len(e.a.Frames) > 1 {
 		e.writeacTL()
+		if len(e.a.Keyframes) > 0 {
+			e.writekfIX()
+		}
 	}
 	if !e.a.Frames[0].IsDefault {
 		e.writefcTL(e.a.Frames[0])
@@ -725,7 +1606,7 @@ func (enc *Encoder) Encode(w io.Writer, a APNG) error {
 	for i := 0; i < len(e.a.Frames); i = i + 1 {
 		if i != 0 && !e.a.Frames[i].IsDefault {
 			e.writefcTL(e.a.Frames[i])
-			e.writefdATs(e.a.Frames[i])
+			e.writefdATs(i)
 		}
 	}
 	e.writeIEND()
@@ -11,7 +11,10 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"io"
+	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -306,3 +309,519 @@ func BenchmarkEncodeRGBA(b *testing.B) {
 		Encode(io.Discard, APNG{Frames: []Frame{{Image: img}}})
 	}
 }
+
+func TestWriterColorKey(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opaque color.NRGBA
+		ct     uint8
+		trns   int
+	}{
+		{"truecolor", color.NRGBA{0x10, 0x80, 0xf0, 0xff}, ctTrueColor, 6},
+		{"grayscale", color.NRGBA{0x40, 0x40, 0x40, 0xff}, ctGrayscale, 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := APNG{Frames: make([]Frame, 2)}
+			for i := range a.Frames {
+				m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+				for y := 0; y < 16; y++ {
+					for x := 0; x < 16; x++ {
+						if (x+y+i)%3 == 0 {
+							m.SetNRGBA(x, y, tc.opaque)
+						} else if x%2 == 0 {
+							// Transparent pixels of differing colors are
+							// all written as the same color key.
+							m.SetNRGBA(x, y, color.NRGBA{0xff, 0x00, 0x00, 0x00})
+						}
+					}
+				}
+				a.Frames[i].Image = m
+			}
+
+			var b bytes.Buffer
+			if err := Encode(&b, a); err != nil {
+				t.Fatal(err)
+			}
+			data := b.Bytes()
+			if ct := data[len(pngHeader)+8+9]; ct != tc.ct {
+				t.Errorf("got color type %d, want %d", ct, tc.ct)
+			}
+			if i := bytes.Index(data, []byte("tRNS")); i < 0 {
+				t.Error("missing tRNS chunk")
+			} else if n := binary.BigEndian.Uint32(data[i-4 : i]); int(n) != tc.trns {
+				t.Errorf("got tRNS length %d, want %d", n, tc.trns)
+			}
+
+			got, err := DecodeAll(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range a.Frames {
+				if err := diff(a.Frames[i].Image, got.Frames[i].Image); err != nil {
+					t.Errorf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterColorKeyAvoidsOpaqueColors(t *testing.T) {
+	// Every shade of gray is used by an opaque pixel, so the key has to be a
+	// truecolor one.
+	m := image.NewNRGBA(image.Rect(0, 0, 257, 1))
+	for x := 0; x < 256; x++ {
+		m.SetNRGBA(x, 0, color.NRGBA{uint8(x), uint8(x), uint8(x), 0xff})
+	}
+	key, gray, ok := colorKey([]Frame{{Image: m}})
+	if !ok || gray {
+		t.Fatalf("got gray=%t ok=%t, want gray=false ok=true", gray, ok)
+	}
+	if key.R == key.G && key.G == key.B {
+		t.Errorf("got gray key %v", key)
+	}
+
+	m1, err := encodeDecode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diff(m, m1); err != nil {
+		t.Error(err)
+	}
+
+	// A partially transparent pixel rules out a color key.
+	m.SetNRGBA(256, 0, color.NRGBA{0, 0, 0, 0x80})
+	if _, _, ok := colorKey([]Frame{{Image: m}}); ok {
+		t.Error("got ok=true for a partially transparent image")
+	}
+}
+
+func TestWriterInterlaced(t *testing.T) {
+	const width, height = 13, 7
+	palette := color.Palette{
+		color.NRGBA{0x00, 0x00, 0x00, 0xff},
+		color.NRGBA{0xff, 0x00, 0x00, 0xff},
+		color.NRGBA{0x00, 0xff, 0x00, 0x80},
+		color.NRGBA{0x00, 0x00, 0xff, 0x00},
+	}
+	testCases := []struct {
+		name string
+		new  func(r image.Rectangle) draw.Image
+	}{
+		{"gray", func(r image.Rectangle) draw.Image { return image.NewGray(r) }},
+		{"gray16", func(r image.Rectangle) draw.Image { return image.NewGray16(r) }},
+		{"nrgba", func(r image.Rectangle) draw.Image { return image.NewNRGBA(r) }},
+		{"rgba64", func(r image.Rectangle) draw.Image { return image.NewRGBA64(r) }},
+		{"paletted", func(r image.Rectangle) draw.Image { return image.NewPaletted(r, palette) }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := APNG{Frames: make([]Frame, 3)}
+			for i := range a.Frames {
+				r := image.Rect(0, 0, width, height)
+				if i == 2 {
+					// A small frame, where most of the passes are empty.
+					r = image.Rect(0, 0, 1, 2)
+					a.Frames[i].XOffset, a.Frames[i].YOffset = 3, 4
+				}
+				m := tc.new(r)
+				for y := 0; y < r.Dy(); y++ {
+					for x := 0; x < r.Dx(); x++ {
+						m.Set(x, y, palette[(x*3+y*5+i)%len(palette)])
+					}
+				}
+				a.Frames[i].Image = m
+			}
+
+			var b bytes.Buffer
+			if err := (&Encoder{Interlaced: true}).Encode(&b, a); err != nil {
+				t.Fatal(err)
+			}
+			if it := b.Bytes()[len(pngHeader)+8+12]; it != itAdam7 {
+				t.Errorf("got interlace method %d, want %d", it, itAdam7)
+			}
+			got, err := DecodeAll(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Frames) != len(a.Frames) {
+				t.Fatalf("got %d frames, want %d", len(got.Frames), len(a.Frames))
+			}
+			for i := range a.Frames {
+				if err := diff(a.Frames[i].Image, got.Frames[i].Image); err != nil {
+					t.Errorf("frame %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterNumericLevelsAndStrategies(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 5), uint8(x ^ y), uint8(x + y)})
+		}
+	}
+	a := APNG{Frames: []Frame{{Image: m}, {Image: m}}}
+	strategies := []CompressionStrategy{DefaultStrategy, SmallestOfLevelAndHuffman, HuffmanOnlyStrategy, SmallestOfBestSpeedAndHuffman}
+	for level := CompressionLevel(1); level <= 9; level++ {
+		for _, strategy := range strategies {
+			var b bytes.Buffer
+			enc := &Encoder{CompressionLevel: level, CompressionStrategy: strategy}
+			if err := enc.Encode(&b, a); err != nil {
+				t.Fatalf("level %d, strategy %d: %v", level, strategy, err)
+			}
+			got, err := DecodeAll(&b)
+			if err != nil {
+				t.Fatalf("level %d, strategy %d: %v", level, strategy, err)
+			}
+			for i := range a.Frames {
+				if err := diff(a.Frames[i].Image, got.Frames[i].Image); err != nil {
+					t.Errorf("level %d, strategy %d, frame %d: %v", level, strategy, i, err)
+				}
+			}
+		}
+	}
+
+	// Invalid settings are rejected before anything is written.
+	var b bytes.Buffer
+	if err := (&Encoder{CompressionLevel: 10}).Encode(&b, a); err == nil || b.Len() > 0 {
+		t.Errorf("level 10: got error %v after %d bytes, want an error before any", err, b.Len())
+	}
+	if err := (&Encoder{CompressionStrategy: 42}).Encode(&b, a); err == nil || b.Len() > 0 {
+		t.Errorf("strategy 42: got error %v after %d bytes, want an error before any", err, b.Len())
+	}
+}
+
+func TestWriterStrategyPicksSmallest(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 96, 64))
+	rng := rand.New(rand.NewSource(1))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i/7) + uint8(rng.Intn(3))
+	}
+	a := APNG{Frames: []Frame{{Image: m}}}
+	size := func(level CompressionLevel, strategy CompressionStrategy) int {
+		var b bytes.Buffer
+		if err := (&Encoder{CompressionLevel: level, CompressionStrategy: strategy}).Encode(&b, a); err != nil {
+			t.Fatal(err)
+		}
+		return b.Len()
+	}
+	huffman := size(DefaultCompression, HuffmanOnlyStrategy)
+	for _, test := range []struct {
+		strategy CompressionStrategy
+		level    CompressionLevel
+	}{
+		{SmallestOfLevelAndHuffman, 6},
+		{SmallestOfBestSpeedAndHuffman, BestSpeed},
+	} {
+		want := size(test.level, DefaultStrategy)
+		if huffman < want {
+			want = huffman
+		}
+		if got := size(6, test.strategy); got != want {
+			t.Errorf("strategy %d: got %d bytes, want %d", test.strategy, got, want)
+		}
+	}
+}
+
+// rowFilters returns the filter type byte of every row in the first IDAT
+// chunk of a non-interlaced PNG.
+func rowFilters(t *testing.T, data []byte, rowSize int) []byte {
+	i := bytes.Index(data, []byte("IDAT"))
+	if i < 0 {
+		t.Fatal("missing IDAT chunk")
+	}
+	length := binary.BigEndian.Uint32(data[i-4 : i])
+	r, err := zlib.NewReader(bytes.NewReader(data[i+4 : i+4+int(length)]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filters []byte
+	for j := 0; j < len(raw); j += rowSize {
+		filters = append(filters, raw[j])
+	}
+	return filters
+}
+
+func TestWriterFilterStrategies(t *testing.T) {
+	const width, height = 40, 30
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	paletted := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{
+		color.Black, color.White, color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0x80},
+	})
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			nrgba.SetNRGBA(x, y, color.NRGBA{uint8(x * y), uint8(x * 6), uint8(y * 8), uint8(255 - x)})
+			gray.SetGray(x, y, color.Gray{uint8(x*x + y)})
+			paletted.SetColorIndex(x, y, uint8((x/3+y/2)%4))
+		}
+	}
+	images := []struct {
+		name    string
+		m       image.Image
+		rowSize int
+	}{
+		{"nrgba", nrgba, 1 + width*4},
+		{"gray", gray, 1 + width},
+		{"paletted", paletted, 1 + width/4},
+	}
+	strategies := []FilterStrategy{
+		DefaultFilter, NoneFilter, SubFilter, UpFilter, AverageFilter, PaethFilter,
+		AdaptiveFilter, EntropyFilter, BruteForceFilter,
+	}
+	for _, im := range images {
+		for _, s := range strategies {
+			t.Run(fmt.Sprintf("%s-%d", im.name, s), func(t *testing.T) {
+				var b bytes.Buffer
+				if err := (&Encoder{FilterStrategy: s}).Encode(&b, APNG{Frames: []Frame{{Image: im.m}}}); err != nil {
+					t.Fatal(err)
+				}
+				filters := rowFilters(t, b.Bytes(), im.rowSize)
+				if len(filters) != height {
+					t.Fatalf("got %d rows, want %d", len(filters), height)
+				}
+				for y, f := range filters {
+					switch {
+					case s >= NoneFilter && s <= PaethFilter:
+						if want := byte(s - NoneFilter); f != want {
+							t.Errorf("row %d: got filter %d, want %d", y, f, want)
+						}
+					case s == DefaultFilter && im.name == "paletted":
+						if f != ftNone {
+							t.Errorf("row %d: got filter %d, want %d", y, f, ftNone)
+						}
+					}
+				}
+				m, err := Decode(&b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := diff(im.m, m); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+
+	if err := (&Encoder{FilterStrategy: 42}).Encode(io.Discard, APNG{Frames: []Frame{{Image: gray}}}); err == nil {
+		t.Error("filter strategy 42: got nil error, want non-nil")
+	}
+}
+
+type syncPool struct {
+	mu      sync.Mutex
+	buffers []*EncoderBuffer
+	gets    int
+	puts    int
+}
+
+func (p *syncPool) Get() *EncoderBuffer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gets++
+	if len(p.buffers) == 0 {
+		return nil
+	}
+	b := p.buffers[len(p.buffers)-1]
+	p.buffers = p.buffers[:len(p.buffers)-1]
+	return b
+}
+
+func (p *syncPool) Put(b *EncoderBuffer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.puts++
+	p.buffers = append(p.buffers, b)
+}
+
+func TestWriterConcurrency(t *testing.T) {
+	var a APNG
+	for i := 0; i < 12; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+		for j := range m.Pix {
+			m.Pix[j] = uint8(j*(i+1) + j/7)
+		}
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNumerator: uint16(i)})
+	}
+	a.Frames[0].IsDefault = true
+
+	var want bytes.Buffer
+	if err := (&Encoder{ChunkSize: 1000}).Encode(&want, a); err != nil {
+		t.Fatal(err)
+	}
+	for _, concurrency := range []int{2, 3, 16} {
+		pool := &syncPool{}
+		enc := &Encoder{ChunkSize: 1000, Concurrency: concurrency, BufferPool: pool}
+		for run := 0; run < 2; run++ {
+			var got bytes.Buffer
+			if err := enc.Encode(&got, a); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("concurrency %d, run %d: output differs from sequential encoding", concurrency, run)
+			}
+		}
+		if pool.gets < 2*(concurrency+1) {
+			t.Errorf("concurrency %d: buffer pool used %d times, want at least %d", concurrency, pool.gets, 2*(concurrency+1))
+		}
+	}
+
+	// Every goroutine has returned its buffers by the time Encode fails.
+	pool := &syncPool{}
+	failing := &Encoder{
+		Concurrency: 4,
+		BufferPool:  pool,
+		CompressionWriter: func(w io.Writer) (CompressionWriter, error) {
+			return nil, fmt.Errorf("no compression writer")
+		},
+	}
+	if err := failing.Encode(io.Discard, a); err == nil || err.Error() != "no compression writer" {
+		t.Errorf("got error %v, want the compression writer's error", err)
+	}
+	pool.mu.Lock()
+	if pool.gets != pool.puts {
+		t.Errorf("after a failed encode: %d buffers taken from the pool, %d returned", pool.gets, pool.puts)
+	}
+	pool.mu.Unlock()
+}
+
+// genericImage hides the concrete type of an image, so that the encoder
+// takes its generic, per-pixel path.
+type genericImage struct {
+	image.Image
+}
+
+// wideColorImages returns an image of each type that the encoder has a
+// 16-bit or YCbCr fast path for, with noise.
+func wideColorImages(width, height int) map[string]image.Image {
+	r := rand.New(rand.NewSource(1))
+	rect := image.Rect(0, 0, width, height)
+	m := map[string]image.Image{}
+	for name, ratio := range map[string]image.YCbCrSubsampleRatio{
+		"ycbcr444": image.YCbCrSubsampleRatio444,
+		"ycbcr422": image.YCbCrSubsampleRatio422,
+		"ycbcr420": image.YCbCrSubsampleRatio420,
+	} {
+		ycbcr := image.NewYCbCr(rect, ratio)
+		for i := range ycbcr.Y {
+			ycbcr.Y[i] = uint8(r.Intn(256))
+		}
+		for i := range ycbcr.Cb {
+			ycbcr.Cb[i], ycbcr.Cr[i] = uint8(r.Intn(256)), uint8(r.Intn(256))
+		}
+		m[name] = ycbcr
+	}
+	gray16 := image.NewGray16(rect)
+	cmyk := image.NewCMYK(rect)
+	rgba64 := image.NewRGBA64(rect)
+	nrgba64 := image.NewNRGBA64(rect)
+	for _, pix := range [][]uint8{gray16.Pix, cmyk.Pix, rgba64.Pix, nrgba64.Pix} {
+		r.Read(pix)
+	}
+	opaqueRGBA64 := image.NewRGBA64(rect)
+	opaqueNRGBA64 := image.NewNRGBA64(rect)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := rgba64.RGBA64At(x, y)
+			// Keep the color premultiplied, with some fully transparent pixels.
+			switch x % 3 {
+			case 0:
+				c = color.RGBA64{}
+			case 1:
+				c.A = 0xffff
+			}
+			c.R, c.G, c.B = min16(c.R, c.A), min16(c.G, c.A), min16(c.B, c.A)
+			rgba64.SetRGBA64(x, y, c)
+			opaqueRGBA64.SetRGBA64(x, y, color.RGBA64{c.R, c.G, c.B, 0xffff})
+			n := nrgba64.NRGBA64At(x, y)
+			opaqueNRGBA64.SetNRGBA64(x, y, color.NRGBA64{n.R, n.G, n.B, 0xffff})
+		}
+	}
+	m["gray16"], m["cmyk"] = gray16, cmyk
+	m["rgba64"], m["nrgba64"] = rgba64, nrgba64
+	m["rgba64-opaque"], m["nrgba64-opaque"] = opaqueRGBA64, opaqueNRGBA64
+	return m
+}
+
+func min16(a, b uint16) uint16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestWriterFastPaths(t *testing.T) {
+	encode := func(m image.Image, interlaced bool) []byte {
+		var buf bytes.Buffer
+		enc := &Encoder{Interlaced: interlaced}
+		if err := enc.Encode(&buf, APNG{Frames: []Frame{{Image: m}}}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	for name, m := range wideColorImages(37, 11) {
+		sub := m.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(image.Rect(3, 2, 30, 9))
+		for _, m := range []image.Image{m, sub} {
+			fast := encode(m, false)
+			if !bytes.Equal(fast, encode(genericImage{m}, false)) {
+				t.Errorf("%s, bounds %v: output differs from the generic path", name, m.Bounds())
+			}
+			// The generic path interlaces 16-bit images through image.RGBA64,
+			// which loses the precision of non-premultiplied colors, so
+			// interlacing is checked against the non-interlaced image instead.
+			want, err := Decode(bytes.NewReader(fast))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(bytes.NewReader(encode(m, true)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := diff(want, got); err != nil {
+				t.Errorf("%s, bounds %v, interlaced: %v", name, m.Bounds(), err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeWideColor(b *testing.B) {
+	for name, img := range wideColorImages(640, 480) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Encode(io.Discard, APNG{Frames: []Frame{{Image: img}}})
+			}
+		})
+	}
+}
+
+func TestWriteracTLFrameCount(t *testing.T) {
+	a := movingSquare(3, func(r image.Rectangle) image.Image { return image.NewNRGBA(r) })
+	for _, withDefault := range []bool{false, true} {
+		b := a
+		if withDefault {
+			b.Frames = append([]Frame{{Image: a.Frames[0].Image, IsDefault: true}}, a.Frames...)
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(buf.Bytes(), []byte("acTL"))
+		if i < 0 {
+			t.Fatal("no acTL chunk")
+		}
+		// A default image is not one of the frames of the animation.
+		if n := binary.BigEndian.Uint32(buf.Bytes()[i+4:]); n != 3 {
+			t.Errorf("default image %v: acTL num_frames is %d, want 3", withDefault, n)
+		}
+	}
+}